@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessLogEntry is one line of the JSON access log.
+type accessLogEntry struct {
+	Timestamp      time.Time `json:"timestamp"`
+	RequestID      string    `json:"request_id"`
+	Method         string    `json:"method"`
+	ClientIP       string    `json:"client_ip"`
+	Upstream       string    `json:"upstream,omitempty"`
+	UpstreamStatus int       `json:"upstream_status,omitempty"`
+	Status         int       `json:"status"`
+	Bytes          int64     `json:"bytes"`
+	DurationMS     float64   `json:"duration_ms"`
+}
+
+type accessLogKey struct{}
+
+// withAccessLog wraps h so that every request writes one JSON line to out
+// once the response, including any rewriting, is complete.
+func withAccessLog(h http.Handler, out io.Writer, logger Logger) http.Handler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(out)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{Timestamp: start, RequestID: requestID(r.Context()), Method: r.Method, ClientIP: r.RemoteAddr}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			entry.ClientIP = host
+		}
+		lw := &accessLogWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+		entry.Status = lw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Bytes = lw.bytes
+		entry.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(entry); err != nil {
+			logger.Printf("Error writing access log: %v", err)
+		}
+	})
+}
+
+// logUpstream records the decoded upstream URL and, once known, its response
+// status on the request's access log entry. It does nothing when the JSON
+// access log is off.
+func logUpstream(r *http.Request, upstream string, status int) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.Upstream = upstream
+		entry.UpstreamStatus = status
+	}
+}
+
+// accessLogWriter records the status code and body size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for
+// flushing and hijacking.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
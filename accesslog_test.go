@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "hello")
+	})
+	tests := []struct {
+		name, path     string
+		upstream       string
+		upstreamStatus int
+		status         int
+	}{
+		{"proxied", "/" + encode(upstream.URL), upstream.URL, http.StatusTeapot, http.StatusTeapot},
+		{"bad encoding", "/!!!", "", 0, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			p := newTestProxy(Options{AccessLog: &buf})
+			req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			rec := serve(p, req)
+
+			var entry accessLogEntry
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("decoding %q: %v", buf.String(), err)
+			}
+			if entry.Method != http.MethodGet || entry.ClientIP != "192.0.2.1" || entry.Timestamp.IsZero() || entry.DurationMS < 0 {
+				t.Errorf("entry = %+v, want method, client IP, timestamp and duration", entry)
+			}
+			if entry.Upstream != tt.upstream || entry.UpstreamStatus != tt.upstreamStatus || entry.Status != tt.status {
+				t.Errorf("upstream %q, upstream status %d, status %d; want %q, %d, %d", entry.Upstream, entry.UpstreamStatus, entry.Status, tt.upstream, tt.upstreamStatus, tt.status)
+			}
+			if entry.Bytes != int64(rec.Body.Len()) {
+				t.Errorf("bytes = %d, want %d", entry.Bytes, rec.Body.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// checkAuth reports whether r may use the proxy. When credentials are
+// configured and r doesn't carry them, it writes a 401 challenge and
+// returns false.
+func (p *Proxy) checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	if p.AuthUser == "" {
+		return true
+	}
+	if user, pass, ok := r.BasicAuth(); ok && p.validCredentials(user, pass) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="proxy", charset="UTF-8"`)
+	p.httpError(w, "", "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// checkProxyAuth is checkAuth for forward-proxy requests, which carry their
+// credentials in Proxy-Authorization and are challenged with a 407.
+func (p *Proxy) checkProxyAuth(w http.ResponseWriter, r *http.Request) bool {
+	if p.AuthUser == "" {
+		return true
+	}
+	probe := &http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	if user, pass, ok := probe.BasicAuth(); ok && p.validCredentials(user, pass) {
+		return true
+	}
+	w.Header().Set("Proxy-Authenticate", `Basic realm="proxy", charset="UTF-8"`)
+	p.httpError(w, "", "Proxy Authentication Required", http.StatusProxyAuthRequired)
+	return false
+}
+
+// validCredentials reports whether user and pass match the configured ones.
+// It compares hashes so neither the contents nor the lengths of the
+// credentials leak through timing.
+func (p *Proxy) validCredentials(user, pass string) bool {
+	userHash, passHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(pass))
+	wantUser, wantPass := sha256.Sum256([]byte(p.AuthUser)), sha256.Sum256([]byte(p.AuthPass))
+	userOK := subtle.ConstantTimeCompare(userHash[:], wantUser[:])
+	passOK := subtle.ConstantTimeCompare(passHash[:], wantPass[:])
+	return userOK&passOK == 1
+}
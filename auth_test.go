@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Authorization"); v != "" {
+			t.Errorf("upstream got Authorization %q", v)
+		}
+	})
+	p := newTestProxy(Options{AuthUser: "alice", AuthPass: "secret"})
+	tests := []struct {
+		name       string
+		user, pass string
+		want       int
+	}{
+		{"correct", "alice", "secret", http.StatusOK},
+		{"wrong password", "alice", "guess", http.StatusUnauthorized},
+		{"wrong user", "bob", "secret", http.StatusUnauthorized},
+		{"missing", "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "/"+encode(upstream.URL), nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			rec := serve(p, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if challenge := rec.Header().Get("WWW-Authenticate"); (tt.want == http.StatusUnauthorized) != (challenge != "") {
+				t.Errorf("WWW-Authenticate = %q", challenge)
+			}
+		})
+	}
+}
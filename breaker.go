@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// maxBreakerHosts bounds how many failing hosts are tracked, like
+// maxStatsHosts.
+const maxBreakerHosts = 1000
+
+// breaker is a per-host circuit breaker. After threshold consecutive
+// upstream failures within window, a host's circuit opens and its requests
+// fail fast for cooldown. Then a single probe request is let through: if it
+// succeeds the circuit closes, and if it fails it stays open for another
+// cooldown.
+type breaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+// circuit is the state of one host with recent failures.
+type circuit struct {
+	failures  int
+	since     time.Time // when the first of the failures happened
+	openUntil time.Time // while open, the end of the cooldown
+}
+
+func newBreaker(threshold int, window, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, window: window, cooldown: cooldown, hosts: make(map[string]*circuit)}
+}
+
+// allow reports whether a request to host may be sent and, if not, how long
+// until the circuit lets a probe through.
+func (b *breaker) allow(host string) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.hosts[host]
+	if c == nil || c.failures < b.threshold {
+		return 0, true
+	}
+	now := time.Now()
+	if wait := c.openUntil.Sub(now); wait > 0 {
+		return wait, false
+	}
+	// Half-open: this request is the probe. Holding off the others for
+	// another cooldown also covers a probe that never reports back.
+	c.openUntil = now.Add(b.cooldown)
+	return 0, true
+}
+
+// record records whether a request to host failed.
+func (b *breaker) record(host string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		delete(b.hosts, host)
+		return
+	}
+	c := b.hosts[host]
+	if c == nil {
+		if len(b.hosts) >= maxBreakerHosts {
+			return
+		}
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+	now := time.Now()
+	if c.failures < b.threshold && now.Sub(c.since) > b.window {
+		c.failures, c.since = 0, now
+	}
+	c.failures++
+	if c.failures >= b.threshold {
+		c.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// recordUpstream feeds the outcome of a request to host to the circuit
+// breaker, if there is one.
+func (p *Proxy) recordUpstream(host string, failed bool) {
+	if p.breaker != nil {
+		p.breaker.record(host, failed)
+	}
+}
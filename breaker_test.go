@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	failing, attempts := true, 0
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if failing {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	})}
+	p := newTestProxy(Options{Client: client, BreakerFailures: 2, BreakerCooldown: cooldown})
+
+	steps := []struct {
+		name         string
+		wait         time.Duration
+		fail         bool
+		want         int
+		wantAttempts int
+	}{
+		{"first failure", 0, true, http.StatusBadGateway, 1},
+		{"second failure opens", 0, true, http.StatusBadGateway, 2},
+		{"open fails fast", 0, true, http.StatusServiceUnavailable, 2},
+		{"failed probe reopens", cooldown, true, http.StatusBadGateway, 3},
+		{"open again", 0, false, http.StatusServiceUnavailable, 3},
+		{"successful probe closes", cooldown, false, http.StatusOK, 4},
+		{"closed", 0, false, http.StatusOK, 5},
+	}
+	for _, step := range steps {
+		time.Sleep(step.wait)
+		failing = step.fail
+		rec := get(p, "http://upstream.test/", "")
+		if rec.Code != step.want || attempts != step.wantAttempts {
+			t.Fatalf("%s: got %d after %d attempts, want %d after %d", step.name, rec.Code, attempts, step.want, step.wantAttempts)
+		}
+		if rec.Code == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", step.name)
+		}
+	}
+	// Other hosts are not affected.
+	failing = true
+	get(p, "http://upstream.test/", "")
+	get(p, "http://upstream.test/", "")
+	failing = false
+	if rec := get(p, "http://other.test/", ""); rec.Code != http.StatusOK {
+		t.Errorf("other host: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
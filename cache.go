@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachingTransport serves cacheable GET responses from an in-memory LRU cache
+// and stores fresh ones as they are read. It is installed on the default
+// upstream client when Options.CacheBytes is set.
+type cachingTransport struct {
+	next  http.RoundTripper
+	cache *responseCache
+}
+
+// newCachingTransport returns a transport that caches up to maxBytes of
+// response bodies in front of next.
+func newCachingTransport(next http.RoundTripper, maxBytes int64) *cachingTransport {
+	return &cachingTransport{
+		next: next,
+		cache: &responseCache{
+			maxBytes: maxBytes,
+			entries:  make(map[string]*list.Element),
+			lru:      list.New(),
+		},
+	}
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only plain GETs are cached. Requests carrying credentials or asking
+	// for part of a resource always go upstream.
+	if req.Method != http.MethodGet || req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+	// A response to a request with cookies may be personalized, so it is
+	// only shared when the upstream marked it public.
+	hasCookie := req.Header.Get("Cookie") != ""
+	key := req.URL.String()
+	if entry := t.cache.get(key, req.Header); entry != nil && (entry.public || !hasCookie) {
+		return entry.response(req), nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	ttl := cacheTTL(resp)
+	public := headerHasToken(resp.Header, "Cache-Control", "public")
+	if ttl <= 0 || hasCookie && !public || resp.ContentLength > t.cache.maxEntryBytes() {
+		return resp, nil
+	}
+	entry := &cacheEntry{
+		key:     key,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		expires: time.Now().Add(ttl),
+		public:  public,
+	}
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				entry.vary = append(entry.vary, name)
+				entry.varyValues = append(entry.varyValues, strings.Join(req.Header.Values(name), ","))
+			}
+		}
+	}
+	resp.Body = &cacheRecorder{
+		ReadCloser: resp.Body,
+		limit:      t.cache.maxEntryBytes(),
+		done: func(body []byte) {
+			entry.body = body
+			t.cache.add(entry)
+		},
+	}
+	return resp, nil
+}
+
+// cacheableStatus lists the status codes whose responses may be cached.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheTTL returns how long resp may be served from the cache, or 0 if it
+// must not be cached. Only responses with explicit freshness information
+// from Cache-Control or Expires are cached.
+func cacheTTL(resp *http.Response) time.Duration {
+	if !cacheableStatus[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" {
+		return 0
+	}
+	for _, value := range resp.Header.Values("Vary") {
+		if strings.TrimSpace(value) == "*" {
+			return 0
+		}
+	}
+
+	maxAge, sharedMaxAge := -1, -1
+	for _, value := range resp.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				return 0
+			case "max-age":
+				if n, err := strconv.Atoi(strings.Trim(arg, `"`)); err == nil {
+					maxAge = n
+				}
+			case "s-maxage":
+				if n, err := strconv.Atoi(strings.Trim(arg, `"`)); err == nil {
+					sharedMaxAge = n
+				}
+			}
+		}
+	}
+	switch {
+	case sharedMaxAge >= 0:
+		return time.Duration(sharedMaxAge) * time.Second
+	case maxAge >= 0:
+		return time.Duration(maxAge) * time.Second
+	}
+
+	expires, err := http.ParseTime(resp.Header.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	return expires.Sub(date)
+}
+
+// responseCache is an LRU cache of upstream responses bounded by the total
+// size of their bodies.
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List // of *cacheEntry, most recently used first
+}
+
+// cacheEntry is a stored response together with the request header values
+// it was selected by.
+type cacheEntry struct {
+	key        string
+	status     int
+	header     http.Header
+	body       []byte
+	expires    time.Time
+	public     bool     // Cache-Control: public, so it may answer requests with cookies
+	vary       []string // request header names listed in Vary
+	varyValues []string // their values in the original request
+}
+
+// maxEntryBytes is the largest body stored, so that one response can't
+// evict most of the cache.
+func (c *responseCache) maxEntryBytes() int64 {
+	return c.maxBytes / 8
+}
+
+// get returns the fresh entry for key whose Vary headers match h, or nil.
+func (c *responseCache) get(key string, h http.Header) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil
+	}
+	for i, name := range entry.vary {
+		if strings.Join(h.Values(name), ",") != entry.varyValues[i] {
+			return nil
+		}
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+// add stores entry, replacing any previous entry for its key and evicting
+// the least recently used entries to stay within maxBytes.
+func (c *responseCache) add(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.body))
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes elem from the cache. c.mu must be held.
+func (c *responseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+}
+
+// response builds a response for req from the entry.
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// cacheRecorder copies a response body as it is read and hands the complete
+// body to done once it reaches EOF, unless it grew past limit.
+type cacheRecorder struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	done     func([]byte)
+}
+
+func (r *cacheRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.overflow {
+		if int64(r.buf.Len()+n) > r.limit {
+			r.overflow = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !r.overflow && r.done != nil {
+		r.done(r.buf.Bytes())
+		r.done = nil
+	}
+	return n, err
+}
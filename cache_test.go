@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		want   time.Duration
+	}{
+		{"max-age", 200, http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute},
+		{"s-maxage wins", 200, http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute},
+		{"expires", 200, http.Header{"Date": {now.Format(http.TimeFormat)}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"no-store", 200, http.Header{"Cache-Control": {"max-age=60, no-store"}}, 0},
+		{"private", 200, http.Header{"Cache-Control": {"private, max-age=60"}}, 0},
+		{"vary star", 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, 0},
+		{"set-cookie", 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, 0},
+		{"no freshness", 200, http.Header{}, 0},
+		{"uncacheable status", 500, http.Header{"Cache-Control": {"max-age=60"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cacheTTL(&http.Response{StatusCode: tt.status, Header: tt.header}); got != tt.want {
+				t.Errorf("cacheTTL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheServesRepeatedGets(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantHits     int
+	}{
+		{"cacheable", "max-age=60", 1},
+		{"no-store", "no-store", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := 0
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				hits++
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				io.WriteString(w, "body")
+			})
+			p := newTestProxy(Options{CacheBytes: 1 << 20})
+			for i := 0; i < 2; i++ {
+				if rec := get(p, upstream.URL, ""); rec.Body.String() != "body" {
+					t.Fatalf("request %d: body = %q, want %q", i+1, rec.Body.String(), "body")
+				}
+			}
+			if hits != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", hits, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestCacheRequestsWithCookies(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantHits     int
+	}{
+		{"not public", "max-age=60", 4},
+		{"public", "public, max-age=60", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := 0
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				hits++
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				io.WriteString(w, "body")
+			})
+			p := newTestProxy(Options{CacheBytes: 1 << 20})
+			getWithCookie := func(target string) {
+				req, _ := http.NewRequest(http.MethodGet, "/"+encode(target), nil)
+				// httptest servers listen on 127.0.0.1.
+				req.Header.Set("Cookie", "127.0.0.1|sid=a")
+				serve(p, req)
+			}
+			// Only a public response is stored for, or served to, a
+			// request with cookies.
+			getWithCookie(upstream.URL)
+			getWithCookie(upstream.URL)
+			get(p, upstream.URL+"/other", "")
+			getWithCookie(upstream.URL + "/other")
+			if hits != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", hits, tt.wantHits)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// htmlToUTF8 decodes an HTML body to UTF-8, which is what the HTML parser
+// expects and what rewriteHTML writes. The encoding comes from a byte order
+// mark, the charset in contentType, or a <meta> declaration, in that order.
+// An undeclared body is taken as UTF-8 if it is valid UTF-8 throughout, and
+// otherwise decoded with the same guess a browser makes. DetermineEncoding
+// alone would guess from the first 1024 bytes only, turning a UTF-8 page
+// whose first non-ASCII character comes later into mojibake.
+func htmlToUTF8(content []byte, contentType string) ([]byte, error) {
+	enc, name, certain := charset.DetermineEncoding(content, contentType)
+	if !certain && !hasMetaCharset(content) && utf8.Valid(content) {
+		return content, nil
+	}
+	if name == "utf-8" {
+		return content, nil
+	}
+	return enc.NewDecoder().Bytes(content)
+}
+
+// hasMetaCharset reports whether a <meta charset> or <meta
+// http-equiv=Content-Type> tag in the first 1024 bytes of content, the part
+// DetermineEncoding looks at, declares a known charset.
+func hasMetaCharset(content []byte) bool {
+	if len(content) > 1024 {
+		content = content[:1024]
+	}
+	z := html.NewTokenizer(bytes.NewReader(content))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "meta" {
+				continue
+			}
+			var label, httpEquiv, metaContent string
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				switch string(key) {
+				case "charset":
+					label = string(val)
+				case "http-equiv":
+					httpEquiv = string(val)
+				case "content":
+					metaContent = string(val)
+				}
+			}
+			if label == "" && strings.EqualFold(httpEquiv, "content-type") {
+				if _, params, err := mime.ParseMediaType(metaContent); err == nil {
+					label = params["charset"]
+				}
+			}
+			if enc, _ := charset.Lookup(label); enc != nil {
+				return true
+			}
+		}
+	}
+}
+
+// setMetaCharset updates a <meta charset> or <meta http-equiv=Content-Type>
+// declaration in n to UTF-8, to match the rewritten document.
+func setMetaCharset(n *html.Node) {
+	if strings.EqualFold(attrValue(n, "http-equiv"), "content-type") {
+		for i, attr := range n.Attr {
+			if strings.EqualFold(attr.Key, "content") {
+				n.Attr[i].Val = "text/html; charset=utf-8"
+			}
+		}
+		return
+	}
+	for i, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, "charset") {
+			n.Attr[i].Val = "utf-8"
+		}
+	}
+}
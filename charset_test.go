@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTMLToUTF8(t *testing.T) {
+	// Longer than the 1024 bytes DetermineEncoding looks at.
+	filler := "<p>" + strings.Repeat("x", 1100) + "</p>"
+	tests := []struct {
+		name, contentType, in, want string
+	}{
+		{"UTF-8 past the prescan", "text/html", filler + "café — ü", filler + "café — ü"},
+		{"UTF-8 early", "text/html", "<p>café — ü</p>", "<p>café — ü</p>"},
+		{"Latin-1 header", "text/html; charset=ISO-8859-1", "<p>caf\xe9 \xfc</p>", "<p>café ü</p>"},
+		{"Latin-1 meta", "text/html", "<meta charset=\"iso-8859-1\"><p>caf\xe9</p>", `<meta charset="iso-8859-1"><p>café</p>`},
+		{"Latin-1 http-equiv", "text/html", "<meta http-equiv=\"Content-Type\" content=\"text/html; charset=latin1\"><p>caf\xe9</p>", `<meta http-equiv="Content-Type" content="text/html; charset=latin1"><p>café</p>`},
+		{"meta wins over valid UTF-8", "text/html", "<meta charset=windows-1252><p>\xc3\xa9</p>", "<meta charset=windows-1252><p>Ã©</p>"},
+		{"undeclared, not UTF-8", "text/html", filler + "caf\xe9", filler + "café"},
+		{"UTF-8 BOM", "text/html; charset=iso-8859-1", "\xef\xbb\xbf<p>café</p>", "\xef\xbb\xbf<p>café</p>"},
+		{"Shift_JIS header", "text/html; charset=Shift_JIS", "<p>\x93\xfa\x96\x7b</p>", "<p>日本</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := htmlToUTF8([]byte(tt.in), tt.contentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("htmlToUTF8 = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatin1PageRoundTrip(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+		io.WriteString(w, "<meta charset=\"iso-8859-1\"><p>Caf\xe9 cr\xe8me br\xfbl\xe9e</p>")
+	})
+	rec := get(newTestProxy(Options{}), upstream.URL, "?browse=1")
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html; charset=utf-8", got)
+	}
+	for _, want := range []string{"<p>Café crème brûlée</p>", `<meta charset="utf-8"/>`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("body = %q, want it to contain %q", rec.Body.String(), want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// retryBackoff is the delay before the first retry; it doubles on each one.
+const retryBackoff = 100 * time.Millisecond
+
+// newTransport returns the transport of the default upstream client. Its
+// dialer refuses to connect to internal addresses unless AllowPrivate is set.
+func (p *Proxy) newTransport() *http.Transport {
+	t := &http.Transport{
+		// No Proxy from the environment: the dial check would otherwise be
+		// applied to that proxy instead of the upstream.
+		DialContext:           p.dial,
+		TLSClientConfig:       p.upstreamTLSConfig(),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if u := p.UpstreamProxy; u != nil && (u.Scheme == "http" || u.Scheme == "https") {
+		// Every connection goes to the proxy, which is often on an internal
+		// address, so only the upstream hosts are checked.
+		t.Proxy = http.ProxyURL(u)
+		t.DialContext = p.baseDialer(false)
+	}
+	return t
+}
+
+// dialFunc opens a network connection like net.Dialer.DialContext.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Dial and DialContext make a dialFunc usable as a golang.org/x/net/proxy
+// forward dialer.
+func (f dialFunc) Dial(network, address string) (net.Conn, error) {
+	return f(context.Background(), network, address)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// baseDialer returns DialContext or, if it is nil, a direct dialer that
+// refuses internal addresses if check is set and AllowPrivate is not.
+func (p *Proxy) baseDialer(check bool) dialFunc {
+	if p.DialContext != nil {
+		return p.DialContext
+	}
+	d := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	if check {
+		d.Control = p.dialControl
+	}
+	return d.DialContext
+}
+
+// upstreamDialer returns the function that opens connections to upstreams,
+// through UpstreamProxy if it is a SOCKS5 proxy. The SOCKS5 proxy resolves
+// the upstream host itself, so only the host check before each request
+// applies, not the dial check.
+func (p *Proxy) upstreamDialer() dialFunc {
+	u := p.UpstreamProxy
+	if u == nil || u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return p.baseDialer(true)
+	}
+	var auth *xproxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &xproxy.Auth{User: u.User.Username(), Password: password}
+	}
+	// SOCKS5 only fails for networks other than TCP.
+	dialer, _ := xproxy.SOCKS5("tcp", u.Host, auth, p.baseDialer(false))
+	return dialer.(xproxy.ContextDialer).DialContext
+}
+
+// upstreamTLSConfig returns the TLS settings for connections to upstreams.
+func (p *Proxy) upstreamTLSConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: p.InsecureUpstream,
+		RootCAs:            p.UpstreamCAs,
+		ServerName:         (&url.URL{Host: p.UpstreamHost}).Hostname(),
+	}
+}
+
+// maxRedirects is how many redirects the default client follows, matching
+// http.Client's own limit.
+const maxRedirects = 10
+
+// checkRedirect is the CheckRedirect policy of the default upstream client.
+// Unless FollowRedirects is set, the redirect response itself is returned.
+// Followed redirects must pass the same host checks as the original URL.
+func (p *Proxy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if !p.FollowRedirects {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return p.checkUpstreamHost(req.Context(), req.URL.Hostname())
+}
+
+// upstreamTimeout returns the timeout for a request to host: that of the
+// most specific UpstreamTimeouts domain it is on, or UpstreamTimeout if the
+// Client is the default one. Zero means no timeout beyond the Client's.
+func (p *Proxy) upstreamTimeout(host string) time.Duration {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	timeout, matched := time.Duration(0), ""
+	for domain, t := range p.UpstreamTimeouts {
+		if (host == domain || strings.HasSuffix(host, "."+domain)) && len(domain) > len(matched) {
+			timeout, matched = t, domain
+		}
+	}
+	if matched == "" && p.defaultClient {
+		return p.UpstreamTimeout
+	}
+	return timeout
+}
+
+// doUpstream sends req with the upstream client. Requests that isRetryable
+// allows are retried with exponential backoff when no response was
+// received, up to MaxRetries times, with a buffered body sent anew each
+// time.
+func (p *Proxy) doUpstream(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := p.Client.Do(req)
+		if err == nil || attempt >= p.MaxRetries || !isRetryable(req, err) {
+			return resp, err
+		}
+		delay := retryBackoff << attempt
+		p.logger(req.Context()).Printf("Upstream request to %s failed (attempt %d of %d), retrying in %s: %v", req.URL, attempt+1, p.MaxRetries+1, delay, err)
+		select {
+		case <-req.Context().Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// isRetryable reports whether req can safely be sent again after err.
+func isRetryable(req *http.Request, err error) bool {
+	// A streamed body has already been consumed by the failed attempt; a
+	// buffered one can be replayed.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	// Cancellations, timeouts and blocked addresses would fail the same way again.
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errBlockedAddress) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	// Other methods may not be idempotent, so they are only sent again if
+	// the upstream can't have received them.
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
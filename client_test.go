@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// roundTripFunc turns a function into an http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRetries(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	tests := []struct {
+		name         string
+		method       string
+		err          error
+		failures     int
+		maxRetries   int
+		maxBuffer    int64
+		maxBody      int64
+		wantStatus   int
+		wantAttempts int
+	}{
+		{"succeeds on third attempt", http.MethodGet, dialErr, 2, 2, 0, 0, http.StatusOK, 3},
+		{"gives up", http.MethodGet, dialErr, 2, 1, 0, 0, http.StatusBadGateway, 2},
+		{"disabled", http.MethodGet, dialErr, 1, 0, 0, 0, http.StatusBadGateway, 1},
+		{"GET with a body limit", http.MethodGet, dialErr, 1, 2, 0, 1024, http.StatusOK, 2},
+		{"buffered POST after dial error", http.MethodPost, dialErr, 1, 2, 1024, 0, http.StatusOK, 2},
+		{"buffered POST with a body limit", http.MethodPost, dialErr, 1, 2, 1024, 1024, http.StatusOK, 2},
+		{"buffered POST after read error", http.MethodPost, readErr, 1, 2, 1024, 0, http.StatusBadGateway, 1},
+		{"streamed POST", http.MethodPost, dialErr, 1, 2, 0, 0, http.StatusBadGateway, 1},
+		{"POST larger than the buffer", http.MethodPost, dialErr, 1, 2, 2, 0, http.StatusBadGateway, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				attempts++
+				if req.Body != nil {
+					if body, _ := io.ReadAll(req.Body); req.Method == http.MethodPost && string(body) != "data" {
+						t.Errorf("attempt %d sent body %q, want %q", attempts, body, "data")
+					}
+				}
+				if attempts <= tt.failures {
+					return nil, tt.err
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+			})}
+			p := newTestProxy(Options{Client: client, MaxRetries: tt.maxRetries, MaxBufferBody: tt.maxBuffer, MaxRequestBody: tt.maxBody})
+			var body io.Reader
+			if tt.method == http.MethodPost {
+				body = strings.NewReader("data")
+			}
+			rec := serve(p, httptest.NewRequest(tt.method, "/"+encode("http://upstream.test/"), body))
+			if rec.Code != tt.wantStatus || attempts != tt.wantAttempts {
+				t.Errorf("got status %d after %d attempts, want %d after %d", rec.Code, attempts, tt.wantStatus, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// newSOCKS5Server starts a minimal SOCKS5 proxy without authentication that
+// supports CONNECT. The address of each connection it makes is sent on the
+// returned channel.
+func newSOCKS5Server(t *testing.T) (net.Listener, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	targets := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Greeting: version, method count, methods; accept "no auth".
+				header := make([]byte, 2)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				io.ReadFull(conn, make([]byte, header[1]))
+				conn.Write([]byte{5, 0})
+				// Request: version, command, reserved, address type.
+				req := make([]byte, 4)
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				var host string
+				switch req[3] {
+				case 1:
+					ip := make([]byte, 4)
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 3:
+					n := make([]byte, 1)
+					io.ReadFull(conn, n)
+					name := make([]byte, n[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				default:
+					return
+				}
+				port := make([]byte, 2)
+				io.ReadFull(conn, port)
+				target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				targets <- target
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln, targets
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "direct")
+	})
+	upstreamHost := mustParse(t, upstream.URL).Host
+
+	socks, socksTargets := newSOCKS5Server(t)
+	httpTargets := make(chan string, 10)
+	httpProxy := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		httpTargets <- r.URL.Host
+		io.WriteString(w, "via HTTP proxy")
+	})
+
+	tests := []struct {
+		name     string
+		proxyURL string
+		targets  <-chan string
+		want     string
+	}{
+		{"SOCKS5", "socks5://" + socks.Addr().String(), socksTargets, "direct"},
+		{"HTTP", httpProxy.URL, httpTargets, "via HTTP proxy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(Options{UpstreamProxy: mustParse(t, tt.proxyURL)})
+			if rec := get(p, upstream.URL, ""); rec.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.want)
+			}
+			select {
+			case target := <-tt.targets:
+				if target != upstreamHost {
+					t.Errorf("proxy connected to %s, want %s", target, upstreamHost)
+				}
+			default:
+				t.Error("the request did not go through the proxy")
+			}
+		})
+	}
+}
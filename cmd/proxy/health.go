@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// version is the build version reported by the health endpoint. It can be
+// set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// startTime is used to report uptime.
+var startTime = time.Now()
+
+// healthHandler answers liveness and readiness probes.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "ok",
+		"uptime":  time.Since(startTime).Round(time.Second).String(),
+		"version": version,
+	})
+}
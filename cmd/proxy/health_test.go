@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	tests := []struct {
+		field, want string
+	}{
+		{"status", "ok"},
+		{"version", version},
+	}
+	for _, tt := range tests {
+		if body[tt.field] != tt.want {
+			t.Errorf("%s = %q, want %q", tt.field, body[tt.field], tt.want)
+		}
+	}
+	if body["uptime"] == "" {
+		t.Error("uptime is missing")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"proxy"
+)
+
+func main() {
+	var opts proxy.Options
+	addr := flag.String("addr", envOr("PROXY_ADDR", ":8080"), "listen address (env PROXY_ADDR)")
+	flag.BoolVar(&opts.AllowPrivate, "allow-private", false, "allow upstreams on loopback, private, and link-local addresses")
+	flag.Func("deny-hosts", "comma-separated domains that may never be proxied, including their subdomains", func(value string) error {
+		opts.DenyHosts = append(opts.DenyHosts, strings.Split(value, ",")...)
+		return nil
+	})
+	flag.DurationVar(&opts.UpstreamTimeout, "upstream-timeout", 30*time.Second, "total timeout for each upstream request; server-sent event streams are exempt once their headers arrive")
+	flag.Func("upstream-host-timeout", `domain=duration overriding -upstream-timeout for upstreams on that domain and its subdomains, e.g. "slow.example.com=2m"; repeatable`, func(value string) error {
+		domain, duration, ok := strings.Cut(value, "=")
+		if !ok || strings.TrimSpace(domain) == "" {
+			return fmt.Errorf("want domain=duration, got %q", value)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(duration))
+		if err != nil {
+			return err
+		}
+		if opts.UpstreamTimeouts == nil {
+			opts.UpstreamTimeouts = make(map[string]time.Duration)
+		}
+		opts.UpstreamTimeouts[strings.TrimSpace(domain)] = timeout
+		return nil
+	})
+	flag.BoolVar(&opts.InsecureUpstream, "insecure-upstream", false, "skip verification of upstream TLS certificates")
+	upstreamCA := flag.String("upstream-ca", "", "PEM file of CA certificates trusted for upstreams instead of the system roots")
+	enableRewriteTest := flag.Bool("enable-rewrite-test", false, "serve /rewrite-test, which rewrites POSTed content against ?base= without proxying, for debugging the rewriters")
+	errorTemplate := flag.String("error-template", "", "html/template file rendering error pages, with .Status, .StatusText, .Message and .URL; plain text if unset")
+	flag.Func("upstream-proxy", "http://, https:// or socks5:// URL of a proxy for all upstream connections (default direct)", func(value string) error {
+		u, err := url.Parse(value)
+		if err != nil {
+			return err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		if u.Host == "" {
+			return errors.New("missing proxy host")
+		}
+		opts.UpstreamProxy = u
+		return nil
+	})
+	flag.BoolVar(&opts.FollowRedirects, "follow-redirects", true, "follow upstream redirects instead of passing them to the client")
+	flag.IntVar(&opts.MaxRetries, "max-retries", 2, "retries for upstream requests that fail to connect; request bodies must fit -max-buffer-body")
+	flag.IntVar(&opts.MaxConcurrent, "max-concurrent", 0, "most requests proxied at once; further requests get 503 (0 means no limit)")
+	flag.IntVar(&opts.BreakerFailures, "breaker-failures", 0, "consecutive upstream failures after which a host's requests fail fast with 503 (0 disables the circuit breaker)")
+	flag.DurationVar(&opts.BreakerWindow, "breaker-window", time.Minute, "window within which -breaker-failures must occur")
+	flag.DurationVar(&opts.BreakerCooldown, "breaker-cooldown", 30*time.Second, "how long a host's requests fail fast before one is let through as a probe")
+	flag.BoolVar(&opts.EnableHeaderInjection, "enable-header-injection", false, "turn h_Name=value query parameters of proxy URLs into upstream request headers, for debugging")
+	flag.BoolVar(&opts.ForwardClientIP, "forward-client-ip", false, "send the client IP upstream in X-Forwarded-For and Forwarded headers")
+	flag.Int64Var(&opts.MaxRequestBody, "max-request-body", 0, "largest request body in bytes passed upstream; larger uploads get 413 (0 means no limit)")
+	flag.Func("block-content-type", `comma-separated media types of upstream responses to refuse, e.g. "video/*,application/zip"`, func(value string) error {
+		for _, media := range strings.Split(value, ",") {
+			if media = strings.TrimSpace(media); media != "" {
+				opts.BlockContentTypes = append(opts.BlockContentTypes, media)
+			}
+		}
+		return nil
+	})
+	flag.IntVar(&opts.BlockStatus, "block-status", http.StatusForbidden, "status code for responses refused by -block-content-type, e.g. 403 or 415")
+	flag.Int64Var(&opts.MaxBufferBody, "max-buffer-body", 0, "largest request body in bytes buffered so retries and followed redirects can resend it; larger bodies are streamed (0 disables buffering)")
+	flag.Int64Var(&opts.MaxRewriteBytes, "max-rewrite-bytes", 10<<20, "largest body buffered for rewriting; larger bodies are streamed unrewritten")
+	flag.DurationVar(&opts.FlushInterval, "flush-interval", 0, "longest delay before streamed response data is flushed to the client; negative flushes after every read, 0 leaves it to the server")
+	flag.StringVar(&opts.BasePath, "base-path", "/", "path prefix the proxy is mounted at, e.g. /proxy/")
+	flag.IntVar(&opts.MaxURLLength, "max-url-len", 8<<10, "longest encoded upstream URL accepted; longer ones get 414")
+	flag.StringVar(&opts.DefaultScheme, "default-scheme", "", `scheme ("http" or "https") assumed for upstream URLs without one; by default they are rejected`)
+	flag.StringVar(&opts.BrowseParam, "browse-param", "browse", "query parameter that enables browse mode")
+	flag.Func("cors-origin", `comma-separated origins allowed to call the proxy from a browser with credentials, or "*" for any origin without them; preflights are answered by the proxy`, func(value string) error {
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				opts.CORSOrigins = append(opts.CORSOrigins, origin)
+			}
+		}
+		return nil
+	})
+	flag.BoolVar(&opts.EnableConnect, "enable-connect", false, "allow CONNECT tunnels, turning the service into a general forward proxy")
+	flag.BoolVar(&opts.EnableForwardProxy, "enable-forward-proxy", false, "proxy absolute-form requests such as \"GET http://host/path\" to the URL they name, as a forward proxy")
+	flag.BoolVar(&opts.RewriteJSON, "rewrite-json", false, "rewrite absolute URLs in JSON responses in browse mode")
+	flag.BoolVar(&opts.RewriteAJAX, "rewrite-ajax", false, "rewrite root-relative URLs passed to AJAX helpers such as axios and jQuery in browse mode")
+	flag.Func("rewrite-type", `rewrite a media type in browse mode as "type=html", "css", "javascript", "json", "xml" or "manifest", or not at all with "type="; repeatable`, func(value string) error {
+		mediaType, name, ok := strings.Cut(value, "=")
+		if !ok {
+			return errors.New(`want "type=rewriter"`)
+		}
+		switch name {
+		case "", "html", "css", "javascript", "json", "xml", "manifest":
+		default:
+			return fmt.Errorf("unknown rewriter %q", name)
+		}
+		if opts.RewriteTypes == nil {
+			opts.RewriteTypes = make(map[string]string)
+		}
+		opts.RewriteTypes[mediaType] = name
+		return nil
+	})
+	flag.StringVar(&opts.UpstreamHost, "upstream-host", "", "Host header sent upstream instead of the decoded URL's host, for IP-addressed virtual hosts; TLS certificates are verified against it")
+	flag.BoolVar(&opts.CompressOutput, "compress-output", false, "gzip rewritten responses for clients that accept gzip")
+	flag.BoolVar(&opts.SniffContent, "sniff-content", false, "detect the type of untyped or application/octet-stream responses from their first bytes")
+	flag.BoolVar(&opts.RewriteFallback, "rewrite-fallback", false, "serve bodies that fail to rewrite unrewritten instead of answering with 500")
+	flag.BoolVar(&opts.SameOriginOnly, "same-origin-only", false, "in browse mode, only route HTML links and subresources on the page's own host through the proxy")
+	flag.Func("extra-attr", `rewrite another URL attribute in browse mode, as "element:attribute", e.g. "amp-img:src"; repeatable`, func(value string) error {
+		element, attr, ok := strings.Cut(value, ":")
+		if !ok || element == "" || attr == "" {
+			return errors.New(`want "element:attribute"`)
+		}
+		if opts.ExtraURLAttrs == nil {
+			opts.ExtraURLAttrs = make(map[string][]string)
+		}
+		opts.ExtraURLAttrs[element] = append(opts.ExtraURLAttrs[element], attr)
+		return nil
+	})
+	flag.StringVar(&opts.UserAgent, "user-agent", "", "User-Agent sent upstream instead of the client's")
+	flag.BoolVar(&opts.StripCSP, "strip-csp", false, "remove Content-Security-Policy headers in browse mode instead of rewriting them")
+	flag.Func("add-header", `header set on every proxied response, as "Name: Value", overriding the upstream's; repeatable`, func(value string) error {
+		name, value, ok := strings.Cut(value, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return errors.New(`want "Name: Value"`)
+		}
+		if opts.AddHeaders == nil {
+			opts.AddHeaders = make(http.Header)
+		}
+		opts.AddHeaders.Add(name, strings.TrimSpace(value))
+		return nil
+	})
+	flag.Func("remove-header", "comma-separated headers removed from every proxied response", func(value string) error {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				opts.RemoveHeaders = append(opts.RemoveHeaders, name)
+			}
+		}
+		return nil
+	})
+	flag.BoolVar(&opts.BlockRobots, "block-robots", false, "ask search engines not to index proxied pages, with X-Robots-Tag and a /robots.txt disallowing everything")
+	logFormat := flag.String("log-format", "text", `request log format: "text", or "json" for one JSON object per request on stdout`)
+	flag.StringVar(&opts.AuthUser, "auth-user", "", "require HTTP Basic Auth with this user name (env PROXY_AUTH=user:pass)")
+	flag.StringVar(&opts.AuthPass, "auth-pass", "", "password for -auth-user")
+	cacheMB := flag.Int("cache-mb", 0, "size in MB of the in-memory cache for cacheable GET responses; 0 disables it")
+	healthPath := flag.String("health-path", "/healthz", "path of the health endpoint; it is never decoded as an upstream URL")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; with -tls-key, serves HTTPS and HTTP/2")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 30*time.Second, "how long a client may take to send the request headers")
+	readTimeout := flag.Duration("read-timeout", 0, "how long a client may take to send the whole request, body included (0 means no limit, for large uploads)")
+	writeTimeout := flag.Duration("write-timeout", 0, "how long writing a response may take, counted from the end of the request headers; it cuts off long downloads and event streams (0 means no limit)")
+	idleTimeout := flag.Duration("idle-timeout", 120*time.Second, "how long an idle keep-alive connection is kept open")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "how long to wait for in-flight requests on SIGINT/SIGTERM")
+	flag.Parse()
+
+	// PROXY_AUTH is read only now, so that -h never prints the password.
+	if opts.AuthUser == "" && opts.AuthPass == "" {
+		opts.AuthUser, opts.AuthPass, _ = strings.Cut(os.Getenv("PROXY_AUTH"), ":")
+	}
+	opts.CacheBytes = int64(*cacheMB) << 20
+	if *upstreamCA != "" {
+		pem, err := os.ReadFile(*upstreamCA)
+		if err != nil {
+			log.Fatalf("Reading -upstream-ca: %v", err)
+		}
+		opts.UpstreamCAs = x509.NewCertPool()
+		if !opts.UpstreamCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %s", *upstreamCA)
+		}
+	}
+	if *errorTemplate != "" {
+		tmpl, err := template.ParseFiles(*errorTemplate)
+		if err != nil {
+			log.Fatalf("Reading -error-template: %v", err)
+		}
+		opts.ErrorTemplate = tmpl
+	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		opts.AccessLog = os.Stdout
+	default:
+		log.Fatalf("Unknown -log-format %q", *logFormat)
+	}
+	switch opts.DefaultScheme {
+	case "", "http", "https":
+	default:
+		log.Fatalf("Unknown -default-scheme %q", opts.DefaultScheme)
+	}
+	if opts.BlockStatus < 400 || opts.BlockStatus > 599 {
+		log.Fatalf("-block-status must be an error status, not %d", opts.BlockStatus)
+	}
+	if (opts.AuthUser == "") != (opts.AuthPass == "") {
+		log.Fatal("-auth-user and -auth-pass must be set together")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together")
+	}
+	p := proxy.NewProxy(opts)
+
+	// Register these paths explicitly so they are never decoded as upstream URLs.
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc(*healthPath, healthHandler)
+	mux.HandleFunc("/stats", p.ServeStats)
+	if opts.BlockRobots {
+		mux.HandleFunc("/robots.txt", p.ServeRobots)
+	}
+	if *enableRewriteTest {
+		mux.HandleFunc("/rewrite-test", p.ServeRewriteTest)
+	}
+	mux.Handle(p.BasePath, p)
+
+	server := newServer(*addr, withConnect(mux, p), serverTimeouts{
+		readHeader: *readHeaderTimeout,
+		read:       *readTimeout,
+		write:      *writeTimeout,
+		idle:       *idleTimeout,
+	})
+	go func() {
+		var err error
+		if *tlsCert != "" {
+			log.Printf("Listening on %s (TLS)", *addr)
+			err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			log.Printf("Listening on %s", *addr)
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a termination signal, then let in-flight requests finish.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, shutting down (waiting up to %s for in-flight requests)", sig, *shutdownTimeout)
+	if err := shutdown(server, *shutdownTimeout); err != nil {
+		log.Fatalf("Shutdown failed: %v", err)
+	}
+	log.Println("Shutdown complete")
+}
+
+// serverTimeouts are the connection timeouts of the server, set by the
+// -read-header-timeout, -read-timeout, -write-timeout and -idle-timeout
+// flags. Zero means no limit.
+type serverTimeouts struct {
+	readHeader, read, write, idle time.Duration
+}
+
+// newServer returns a server for handler listening on addr.
+func newServer(addr string, handler http.Handler, timeouts serverTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.readHeader,
+		ReadTimeout:       timeouts.read,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+	}
+}
+
+// withConnect routes CONNECT requests, which http.ServeMux never matches,
+// and forward-proxy requests, whose paths belong to the upstream, to p and
+// everything else to h.
+func withConnect(h http.Handler, p *proxy.Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || p.EnableForwardProxy && r.URL.IsAbs() {
+			p.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// shutdown stops server from accepting new connections and waits up to
+// timeout for active requests to complete.
+func shutdown(server *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// envOr returns the value of the environment variable key, or def if it is unset or empty.
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
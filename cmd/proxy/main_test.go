@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEnvOr(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"unset", "", ":8080"},
+		{"set", ":9090", ":9090"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PROXY_ADDR", tt.value)
+			if got := envOr("PROXY_ADDR", ":8080"); got != tt.want {
+				t.Errorf("envOr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name          string
+		hold, timeout time.Duration
+		wantErr       error
+	}{
+		{"drains in-flight request", 50 * time.Millisecond, time.Second, nil},
+		{"gives up after timeout", time.Second, 50 * time.Millisecond, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			started := make(chan struct{})
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(tt.hold)
+			})}
+			go server.Serve(ln)
+			defer server.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				resp, err := http.Get("http://" + ln.Addr().String())
+				if err == nil {
+					resp.Body.Close()
+				}
+				done <- err
+			}()
+			<-started
+			if err := shutdown(server, tt.timeout); !errors.Is(err, tt.wantErr) {
+				t.Errorf("shutdown = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				if err := <-done; err != nil {
+					t.Errorf("in-flight request failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts serverTimeouts
+	}{
+		{"defaults", serverTimeouts{readHeader: 30 * time.Second, idle: 120 * time.Second}},
+		{"all set", serverTimeouts{readHeader: time.Second, read: 2 * time.Second, write: 3 * time.Second, idle: 4 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newServer(":8080", http.NotFoundHandler(), tt.timeouts)
+			got := serverTimeouts{
+				readHeader: server.ReadHeaderTimeout,
+				read:       server.ReadTimeout,
+				write:      server.WriteTimeout,
+				idle:       server.IdleTimeout,
+			}
+			if got != tt.timeouts {
+				t.Errorf("server timeouts = %+v, want %+v", got, tt.timeouts)
+			}
+			if server.Addr != ":8080" {
+				t.Errorf("Addr = %q, want :8080", server.Addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// proxyConnect opens a TCP tunnel to the host:port named by a CONNECT request.
+func (p *Proxy) proxyConnect(w http.ResponseWriter, r *http.Request) {
+	if !p.EnableConnect {
+		p.httpError(w, r.Host, "CONNECT is not enabled", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.checkProxyAuth(w, r) {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		p.httpError(w, r.Host, "Invalid CONNECT target: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.checkUpstreamHost(r.Context(), host); err != nil {
+		p.logger(r.Context()).Printf("Blocked upstream %s: %v", r.Host, err)
+		p.httpError(w, r.Host, "Upstream host is not allowed: "+host, http.StatusForbidden)
+		return
+	}
+	p.logger(r.Context()).Printf("Incoming request: CONNECT %s from %s", r.Host, r.RemoteAddr)
+
+	upstreamConn, err := p.dial(r.Context(), "tcp", r.Host)
+	if errors.Is(err, errBlockedAddress) {
+		p.logger(r.Context()).Printf("Blocked upstream %s: %v", r.Host, err)
+		p.httpError(w, r.Host, "Upstream host is not allowed: "+host, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		p.httpError(w, r.Host, "Upstream dial failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		p.httpError(w, r.Host, "CONNECT not supported: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	if err := tunnel(clientConn, clientBuf, upstreamConn); err != nil {
+		p.logger(r.Context()).Printf("CONNECT tunnel to %s closed: %v", r.Host, err)
+	}
+}
+
+// tunnel copies bytes between a hijacked client connection and an upstream
+// connection in both directions, returning when either side is done.
+// Reads from the client go through clientBuf so bytes it has already
+// buffered are not lost.
+func tunnel(clientConn net.Conn, clientBuf *bufio.ReadWriter, upstreamConn net.Conn) error {
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstreamConn, clientBuf)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(clientConn, upstreamConn)
+		errc <- err
+	}()
+	return <-errc
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Upstream cookies all live on the proxy origin, so in browse mode each one
+// is renamed to carry its scope: "host|name" for a host-only cookie and
+// ".domain|name" for one set with a Domain attribute. scopeRequestCookies
+// then forwards to an upstream only the cookies in its scope, under their
+// original names, so one site's cookies never reach another. Scripts on
+// proxied pages see the scoped names in document.cookie.
+const cookieScopeSep = "|"
+
+// rewriteSetCookies rescopes every Set-Cookie header in h from host, the
+// upstream that sent it, to the proxy origin. Cookies the upstream may not
+// set, for a Domain it isn't in, are dropped.
+func rewriteSetCookies(h http.Header, host string) {
+	var kept []string
+	for _, cookie := range h.Values("Set-Cookie") {
+		if cookie, ok := rewriteSetCookie(cookie, host); ok {
+			kept = append(kept, cookie)
+		}
+	}
+	if kept == nil {
+		h.Del("Set-Cookie")
+		return
+	}
+	h["Set-Cookie"] = kept
+}
+
+// rewriteSetCookie rescopes a single Set-Cookie value from host and reports
+// whether it should be kept. Its name gets the scope prefix. The Domain
+// attribute names the upstream host, which the browser would reject for the
+// proxy, so it is dropped, leaving the scope to the name. Proxied pages
+// don't live under the upstream's paths, so Path becomes "/". Every other
+// attribute, including Secure, HttpOnly and SameSite, is kept as it is.
+func rewriteSetCookie(value, host string) (string, bool) {
+	parts := strings.Split(value, ";")
+	name, val, ok := strings.Cut(parts[0], "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", false
+	}
+	host = cookieHost(host)
+	scope := host
+	kept := []string{""}
+	for _, part := range parts[1:] {
+		attr, arg, _ := strings.Cut(part, "=")
+		switch strings.ToLower(strings.TrimSpace(attr)) {
+		case "domain":
+			domain := cookieHost(strings.TrimPrefix(strings.TrimSpace(arg), "."))
+			if domain == "" {
+				continue
+			}
+			if !domainMatch(host, domain) || isPublicSuffix(domain) && domain != host {
+				return "", false
+			}
+			scope = "." + domain
+			continue
+		case "path":
+			part = " Path=/"
+		}
+		kept = append(kept, part)
+	}
+	kept[0] = scope + cookieScopeSep + name + "=" + strings.TrimSpace(val)
+	return strings.Join(kept, ";"), true
+}
+
+// scopeRequestCookies replaces the Cookie header of an upstream request to
+// host with the cookies the client holds in its scope, under their original
+// names. Cookies of other upstreams stay on the client, and so do unscoped
+// ones, such as the proxy's own, unless keepUnscoped is set: outside browse
+// mode the client's cookies are its own and pass through unchanged.
+func scopeRequestCookies(h http.Header, host string, keepUnscoped bool) {
+	if keepUnscoped && !strings.Contains(strings.Join(h.Values("Cookie"), ""), cookieScopeSep) {
+		return
+	}
+	host = cookieHost(host)
+	var kept []string
+	for _, header := range h.Values("Cookie") {
+		for _, cookie := range strings.Split(header, ";") {
+			name, val, _ := strings.Cut(strings.TrimSpace(cookie), "=")
+			scope, name, ok := strings.Cut(name, cookieScopeSep)
+			if !ok && keepUnscoped && scope != "" {
+				kept = append(kept, strings.TrimSpace(cookie))
+				continue
+			}
+			if !ok || name == "" {
+				continue
+			}
+			if domain, isDomain := strings.CutPrefix(scope, "."); isDomain && domainMatch(host, domain) || scope == host {
+				kept = append(kept, name+"="+val)
+			}
+		}
+	}
+	h.Del("Cookie")
+	if kept != nil {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// cookieHost returns host in the form used in cookie scopes: lowercased,
+// without a trailing dot, and with the colons of IPv6 addresses, which
+// cookie names may not contain, replaced.
+func cookieHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.ReplaceAll(host, ":", "-")
+}
+
+// domainMatch reports whether host is domain or one of its subdomains.
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// isPublicSuffix reports whether domain is a public suffix such as "com" or
+// "co.uk", for which browsers refuse Domain cookies.
+func isPublicSuffix(domain string) bool {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix == domain
+}
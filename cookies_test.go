@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteSetCookie(t *testing.T) {
+	tests := []struct {
+		name, in, host, want string
+		kept                 bool
+	}{
+		{"domain", "sid=x; Domain=example.com; Path=/app", "www.example.com", ".example.com|sid=x; Path=/", true},
+		{"leading dot", "sid=x; domain=.Example.com", "example.com", ".example.com|sid=x", true},
+		{"host only", "sid=x; Path=/app; Secure; HttpOnly; SameSite=Lax", "www.example.com", "www.example.com|sid=x; Path=/; Secure; HttpOnly; SameSite=Lax", true},
+		{"other domain", "sid=x; Domain=other.com", "www.example.com", "", false},
+		{"public suffix", "sid=x; Domain=com", "example.com", "", false},
+		{"no name", "novalue", "example.com", "", false},
+		{"ipv6 host", "sid=x", "::1", "--1|sid=x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, kept := rewriteSetCookie(tt.in, tt.host)
+			if got != tt.want || kept != tt.kept {
+				t.Errorf("rewriteSetCookie(%q, %q) = %q, %v; want %q, %v", tt.in, tt.host, got, kept, tt.want, tt.kept)
+			}
+		})
+	}
+}
+
+func TestScopeRequestCookies(t *testing.T) {
+	const jar = "www.a.com|sid=a; .a.com|pref=1; b.com|sid=b; proxy_session=secret"
+	tests := []struct {
+		host         string
+		keepUnscoped bool
+		want         string
+	}{
+		{"www.a.com", false, "sid=a; pref=1"},
+		{"api.a.com", false, "pref=1"},
+		{"b.com", false, "sid=b"},
+		{"c.com", false, ""},
+		{"b.com", true, "sid=b; proxy_session=secret"},
+		{"c.com", true, "proxy_session=secret"},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Cookie": {jar}}
+		scopeRequestCookies(h, tt.host, tt.keepUnscoped)
+		if got := h.Get("Cookie"); got != tt.want {
+			t.Errorf("Cookie for %s (keepUnscoped %t) = %q, want %q", tt.host, tt.keepUnscoped, got, tt.want)
+		}
+	}
+}
+
+func TestBrowseModeCookiesStayWithTheirUpstream(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "x", Path: "/app"})
+		w.Header().Set("X-Cookie", r.Header.Get("Cookie"))
+	})
+	// httptest servers listen on 127.0.0.1.
+	req, _ := http.NewRequest(http.MethodGet, "/"+encode(upstream.URL)+"?browse=1", nil)
+	req.Header.Set("Cookie", "127.0.0.1|sid=x; example.com|sid=y")
+	rec := serve(newTestProxy(Options{}), req)
+	if got, want := rec.Header().Get("Set-Cookie"), "127.0.0.1|sid=x; Path=/"; got != want {
+		t.Errorf("Set-Cookie = %q, want %q", got, want)
+	}
+	if got, want := rec.Header().Get("X-Cookie"), "sid=x"; got != want {
+		t.Errorf("upstream got Cookie %q, want %q", got, want)
+	}
+}
+
+func TestCookiesOutsideBrowseMode(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "x"})
+		w.Header().Set("X-Cookie", r.Header.Get("Cookie"))
+	})
+	req, _ := http.NewRequest(http.MethodGet, "/"+encode(upstream.URL), nil)
+	req.Header.Set("Cookie", "example.com|sid=y; theme=dark")
+	rec := serve(newTestProxy(Options{}), req)
+	if got, want := rec.Header().Get("Set-Cookie"), "sid=x"; got != want {
+		t.Errorf("Set-Cookie = %q, want %q", got, want)
+	}
+	if got, want := rec.Header().Get("X-Cookie"), "theme=dark"; got != want {
+		t.Errorf("upstream got Cookie %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin value for a
+// browser page at origin, and whether that page may send credentials. Only
+// origins listed explicitly are echoed and get credentials; a "*" entry lets
+// any other origin read responses without them, so a site the proxy has a
+// session with can't be read by every page on the web.
+func (p *Proxy) corsAllowOrigin(origin string) (allow string, credentials bool) {
+	for _, allowed := range p.CORSOrigins {
+		if allowed == "*" {
+			allow = "*"
+		} else if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	return allow, false
+}
+
+// isPreflight reports whether r is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// setCORSHeaders allows r's origin to read the response, and to send
+// credentials, as corsAllowOrigin decides. An allowed origin is echoed
+// rather than answered with "*", which browsers reject for credentialed
+// requests.
+func (p *Proxy) setCORSHeaders(h http.Header, r *http.Request) {
+	addVary(h, "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	allow, credentials := p.corsAllowOrigin(origin)
+	if allow == "" {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", allow)
+	if credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handlePreflight answers a CORS preflight for the proxy itself, allowing
+// whatever method and headers were asked for if the origin is allowed.
+func (p *Proxy) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	p.setCORSHeaders(h, r)
+	if h.Get("Access-Control-Allow-Origin") != "" {
+		h.Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			h.Set("Access-Control-Allow-Headers", headers)
+		}
+		h.Set("Access-Control-Max-Age", "600")
+		addVary(h, "Access-Control-Request-Method, Access-Control-Request-Headers")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeCORSHeaders drops the upstream's own CORS headers, which name the
+// upstream's origin rather than the proxy's.
+func removeCORSHeaders(h http.Header) {
+	for key := range h {
+		if strings.HasPrefix(strings.ToLower(key), "access-control-") {
+			h.Del(key)
+		}
+	}
+}
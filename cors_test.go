@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example")
+	})
+	tests := []struct {
+		name        string
+		origins     []string
+		origin      string
+		preflight   bool
+		allow       string
+		credentials string
+	}{
+		{"listed origin", []string{"https://app.example"}, "https://app.example", false, "https://app.example", "true"},
+		{"listed origin, other case", []string{"https://App.example"}, "https://app.example", false, "https://app.example", "true"},
+		{"unlisted origin", []string{"https://app.example"}, "https://evil.example", false, "", ""},
+		{"wildcard", []string{"*"}, "https://evil.example", false, "*", ""},
+		{"listed beside wildcard", []string{"*", "https://app.example"}, "https://app.example", false, "https://app.example", "true"},
+		{"preflight, listed", []string{"https://app.example"}, "https://app.example", true, "https://app.example", "true"},
+		{"preflight, wildcard", []string{"*"}, "https://evil.example", true, "*", ""},
+		{"preflight, unlisted", []string{"https://app.example"}, "https://evil.example", true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := http.MethodGet
+			if tt.preflight {
+				method = http.MethodOptions
+			}
+			req := httptest.NewRequest(method, "/"+encode(upstream.URL), nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+				req.Header.Set("Access-Control-Request-Headers", "X-Token")
+			}
+			rec := serve(newTestProxy(Options{CORSOrigins: tt.origins}), req)
+			h := rec.Header()
+			if got := h.Get("Access-Control-Allow-Origin"); got != tt.allow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allow)
+			}
+			if got := h.Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, tt.credentials)
+			}
+			if h.Get("Vary") == "" {
+				t.Error("Vary is missing")
+			}
+			if !tt.preflight {
+				return
+			}
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("preflight status = %d, want %d", rec.Code, http.StatusNoContent)
+			}
+			wantMethods, wantHeaders := http.MethodPut, "X-Token"
+			if tt.allow == "" {
+				wantMethods, wantHeaders = "", ""
+			}
+			if got := h.Get("Access-Control-Allow-Methods"); got != wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, wantMethods)
+			}
+			if got := h.Get("Access-Control-Allow-Headers"); got != wantHeaders {
+				t.Errorf("Access-Control-Allow-Headers = %q, want %q", got, wantHeaders)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// cspHeaders are the response headers carrying a Content-Security-Policy.
+var cspHeaders = []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"}
+
+// cspURLDirectives are the directives whose sources govern URLs that the
+// proxy rewrites to its own origin.
+var cspURLDirectives = map[string]bool{
+	"default-src":     true,
+	"script-src":      true,
+	"script-src-elem": true,
+	"script-src-attr": true,
+	"style-src":       true,
+	"style-src-elem":  true,
+	"style-src-attr":  true,
+	"img-src":         true,
+	"font-src":        true,
+	"media-src":       true,
+	"connect-src":     true,
+	"object-src":      true,
+	"frame-src":       true,
+	"child-src":       true,
+	"worker-src":      true,
+	"manifest-src":    true,
+	"prefetch-src":    true,
+	"form-action":     true,
+	"base-uri":        true,
+}
+
+// cspSchemeSource matches scheme-only sources such as "data:" or "https:".
+var cspSchemeSource = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:$`)
+
+// rewriteCSPHeaders rewrites or, if strip is set, removes the CSP headers in h.
+func rewriteCSPHeaders(h http.Header, origin string, strip bool) {
+	for _, name := range cspHeaders {
+		if strip {
+			h.Del(name)
+			continue
+		}
+		policies := h.Values(name)
+		for i, policy := range policies {
+			policies[i] = rewriteCSP(policy, origin)
+		}
+	}
+}
+
+// rewriteCSP adds origin to every URL directive that allows specific hosts,
+// since those hosts' resources are now served from the proxy. Keywords such
+// as 'self', 'unsafe-inline' and 'nonce-...', scheme sources, and directives
+// without host sources (e.g. 'none') are left alone.
+func rewriteCSP(policy, origin string) string {
+	// A header value may hold several comma-separated policies.
+	policies := strings.Split(policy, ",")
+	for p, single := range policies {
+		directives := strings.Split(single, ";")
+		for d, directive := range directives {
+			fields := strings.Fields(directive)
+			if len(fields) < 2 || !cspURLDirectives[strings.ToLower(fields[0])] {
+				continue
+			}
+			hasHost, hasOrigin := false, false
+			for _, source := range fields[1:] {
+				switch {
+				case source == origin:
+					hasOrigin = true
+				case strings.HasPrefix(source, "'"), source == "*", cspSchemeSource.MatchString(source):
+				default:
+					hasHost = true
+				}
+			}
+			if hasHost && !hasOrigin {
+				directives[d] = strings.TrimRight(directive, " \t") + " " + origin
+			}
+		}
+		policies[p] = strings.Join(directives, ";")
+	}
+	return strings.Join(policies, ",")
+}
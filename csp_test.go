@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteCSP(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"host source", "script-src https://cdn.example.com", "script-src https://cdn.example.com " + testOrigin},
+		{"nonce and unsafe-inline kept", "script-src 'nonce-abc+/=' 'unsafe-inline' cdn.example.com", "script-src 'nonce-abc+/=' 'unsafe-inline' cdn.example.com " + testOrigin},
+		{"keywords only", "default-src 'self'; object-src 'none'", "default-src 'self'; object-src 'none'"},
+		{"scheme source", "img-src data: https:", "img-src data: https:"},
+		{"origin already allowed", "img-src a.com " + testOrigin, "img-src a.com " + testOrigin},
+		{"other directive", "report-uri https://r.example.com/csp", "report-uri https://r.example.com/csp"},
+		{"several directives", "default-src a.com; style-src b.com", "default-src a.com " + testOrigin + "; style-src b.com " + testOrigin},
+		{"several policies", "img-src a.com, frame-src b.com", "img-src a.com " + testOrigin + ", frame-src b.com " + testOrigin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteCSP(tt.in, testOrigin); got != tt.want {
+				t.Errorf("rewriteCSP(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteCSPHeaders(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		h := http.Header{}
+		h.Set("Content-Security-Policy", "script-src a.com")
+		h.Set("Content-Security-Policy-Report-Only", "img-src b.com")
+		rewriteCSPHeaders(h, testOrigin, strip)
+		want := map[string]string{
+			"Content-Security-Policy":             "script-src a.com " + testOrigin,
+			"Content-Security-Policy-Report-Only": "img-src b.com " + testOrigin,
+		}
+		for name, value := range want {
+			if strip {
+				value = ""
+			}
+			if got := h.Get(name); got != value {
+				t.Errorf("strip=%v: %s = %q, want %q", strip, name, got, value)
+			}
+		}
+	}
+}
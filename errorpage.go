@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// ErrorPage is the data ErrorTemplate is executed with.
+type ErrorPage struct {
+	Status     int    // the status code, such as 502
+	StatusText string // its text, such as "Bad Gateway"
+	Message    string // what went wrong
+	URL        string // the upstream URL, if it was decoded by then
+}
+
+// httpError replies like http.Error, rendering ErrorTemplate if it is set.
+// upstream is the upstream URL the request was for, or "" if not known.
+func (p *Proxy) httpError(w http.ResponseWriter, upstream, message string, code int) {
+	if p.ErrorTemplate == nil {
+		http.Error(w, message, code)
+		return
+	}
+	var buf bytes.Buffer
+	page := ErrorPage{Status: code, StatusText: http.StatusText(code), Message: message, URL: upstream}
+	if err := p.ErrorTemplate.Execute(&buf, page); err != nil {
+		p.Logger.Printf("Error rendering error page: %v", err)
+		http.Error(w, message, code)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorTemplate(t *testing.T) {
+	// A closed server's address refuses connections.
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	tests := []struct {
+		name     string
+		tmpl     string
+		wantType string
+		want     string
+	}{
+		{"template", `<h1>{{.Status}} {{.StatusText}}</h1><p>{{.URL}}</p>`, "text/html; charset=utf-8", "<h1>502 Bad Gateway</h1><p>" + upstream.URL + "</p>"},
+		{"failing template", `{{.Missing}}`, "text/plain; charset=utf-8", "Upstream request failed"},
+		{"no template", "", "text/plain; charset=utf-8", "Upstream request failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts Options
+			if tt.tmpl != "" {
+				opts.ErrorTemplate = template.Must(template.New("error").Parse(tt.tmpl))
+			}
+			rec := get(newTestProxy(opts), upstream.URL, "")
+			if rec.Code != http.StatusBadGateway {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.want) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorTemplateEscapes(t *testing.T) {
+	p := newTestProxy(Options{ErrorTemplate: template.Must(template.New("error").Parse(`<p>{{.Message}}</p>`))})
+	rec := httptest.NewRecorder()
+	p.httpError(rec, "", "<script>alert(1)</script>", http.StatusBadRequest)
+	if body := rec.Body.String(); strings.Contains(body, "<script>") {
+		t.Errorf("body = %q, want the message escaped", body)
+	}
+}
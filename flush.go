@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// latencyWriter is a writer that flushes what is written to it within
+// latency, so a slowly trickling response reaches the client without
+// waiting for the server's buffer to fill.
+type latencyWriter struct {
+	w       io.Writer
+	flush   func() error
+	latency time.Duration
+
+	mu      sync.Mutex // guards w and the fields below
+	timer   *time.Timer
+	pending bool // whether a flush is scheduled
+}
+
+func newLatencyWriter(w io.Writer, flush func() error, latency time.Duration) *latencyWriter {
+	return &latencyWriter{w: w, flush: flush, latency: latency}
+}
+
+func (l *latencyWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, err := l.w.Write(b)
+	if l.pending {
+		return n, err
+	}
+	l.pending = true
+	if l.timer == nil {
+		l.timer = time.AfterFunc(l.latency, l.delayedFlush)
+	} else {
+		l.timer.Reset(l.latency)
+	}
+	return n, err
+}
+
+func (l *latencyWriter) delayedFlush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.pending { // stopped in the meantime
+		return
+	}
+	l.flush()
+	l.pending = false
+}
+
+// stop cancels any scheduled flush. The writer must not be flushed once
+// the handler has returned.
+func (l *latencyWriter) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = false
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 7230, section 6.1. They
+// describe a single connection and are never forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including any
+// headers named in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// headerHasToken reports whether the comma-separated header name contains token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addVary adds the request header names in value, such as "Origin" or
+// "Accept-Encoding, Cookie", to the Vary header of h, skipping those it
+// already lists. A response that varies on "*" varies on everything, so
+// nothing is added to it.
+func addVary(h http.Header, value string) {
+	if headerHasToken(h, "Vary", "*") {
+		return
+	}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" && !headerHasToken(h, "Vary", name) {
+			h.Add("Vary", name)
+		}
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding of h allows a gzip
+// response: gzip is named without q=0, or, if it isn't named at all, "*"
+// is.
+func acceptsGzip(h http.Header) bool {
+	var named, gzip, wildcard bool
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			allowed := true
+			if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+				weight, err := strconv.ParseFloat(q, 64)
+				allowed = err == nil && weight > 0
+			}
+			if name == "gzip" {
+				named, gzip = true, allowed
+			} else {
+				wildcard = allowed
+			}
+		}
+	}
+	if named {
+		return gzip
+	}
+	return wildcard
+}
+
+// setForwardedHeaders adds the client's address, together with the host and
+// scheme it used to reach the proxy, to the X-Forwarded-For,
+// X-Forwarded-Host, X-Forwarded-Proto and Forwarded (RFC 7239) headers of
+// req. Existing X-Forwarded-For and Forwarded chains are extended.
+func setForwardedHeaders(req, r *http.Request) {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+	} else {
+		req.Header.Set("X-Forwarded-For", clientIP)
+	}
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+
+	// IPv6 addresses must be quoted and bracketed in Forwarded.
+	node := clientIP
+	if strings.Contains(clientIP, ":") {
+		node = `"[` + clientIP + `]"`
+	}
+	forwarded := "for=" + node + ";host=" + quoteForwarded(r.Host) + ";proto=" + proto
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	req.Header.Set("Forwarded", forwarded)
+}
+
+// quoteForwarded quotes a Forwarded parameter value if it is not a plain token.
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]\" \t,;=") {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
+
+// headerParamPrefix marks the proxy URL query parameters that become
+// upstream request headers when EnableHeaderInjection is set, as in
+// ?h_X-Custom=value.
+const headerParamPrefix = "h_"
+
+// cutHeaderParams splits the header parameters out of rawQuery, returning
+// the remaining query in its original order and encoding and the headers.
+// Parameters that don't make a valid header are dropped.
+func cutHeaderParams(rawQuery string) (string, http.Header) {
+	var kept []string
+	headers := make(http.Header)
+	for _, param := range strings.Split(rawQuery, "&") {
+		rawKey, rawValue, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(rawKey)
+		name, ok := strings.CutPrefix(key, headerParamPrefix)
+		if err != nil || !ok {
+			if param != "" {
+				kept = append(kept, param)
+			}
+			continue
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err == nil && httpguts.ValidHeaderFieldName(name) && httpguts.ValidHeaderFieldValue(value) {
+			headers.Add(name, value)
+		}
+	}
+	return strings.Join(kept, "&"), headers
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		in         http.Header
+		want, gone []string
+	}{
+		{
+			name: "standard",
+			in:   http.Header{"Keep-Alive": {"timeout=5"}, "Te": {"trailers"}, "Upgrade": {"h2c"}, "Proxy-Authorization": {"Basic x"}, "Accept": {"*/*"}},
+			want: []string{"Accept"},
+			gone: []string{"Keep-Alive", "Te", "Upgrade", "Proxy-Authorization"},
+		},
+		{
+			name: "named in Connection",
+			in:   http.Header{"Connection": {"X-Custom, x-other", "close"}, "X-Custom": {"1"}, "X-Other": {"2"}, "X-Kept": {"3"}},
+			want: []string{"X-Kept"},
+			gone: []string{"Connection", "X-Custom", "X-Other"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removeHopHeaders(tt.in)
+			for _, name := range tt.want {
+				if tt.in.Get(name) == "" {
+					t.Errorf("%s was removed", name)
+				}
+			}
+			for _, name := range tt.gone {
+				if v := tt.in.Values(name); v != nil {
+					t.Errorf("%s = %q, want it removed", name, v)
+				}
+			}
+		})
+	}
+}
+
+func TestHopHeadersNotProxied(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("X-Custom"); v != "" {
+			t.Errorf("upstream got X-Custom %q", v)
+		}
+		w.Header().Set("Connection", "X-Upstream")
+		w.Header().Set("X-Upstream", "1")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL), nil)
+	req.Header.Set("Connection", "X-Custom")
+	req.Header.Set("X-Custom", "1")
+	rec := serve(newTestProxy(Options{}), req)
+	if v := rec.Header().Get("X-Upstream"); v != "" {
+		t.Errorf("response has X-Upstream %q", v)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	var got http.Header
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	})
+	tests := []struct {
+		name       string
+		enabled    bool
+		remoteAddr string
+		prior      string
+		want       map[string]string
+	}{
+		{
+			name: "new chain", enabled: true, remoteAddr: "192.0.2.1:1234",
+			want: map[string]string{
+				"X-Forwarded-For":   "192.0.2.1",
+				"X-Forwarded-Host":  "proxy.test",
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "for=192.0.2.1;host=proxy.test;proto=http",
+			},
+		},
+		{
+			name: "existing chain", enabled: true, remoteAddr: "192.0.2.1:1234", prior: "203.0.113.7",
+			want: map[string]string{"X-Forwarded-For": "203.0.113.7, 192.0.2.1"},
+		},
+		{
+			name: "IPv6 client", enabled: true, remoteAddr: "[2001:db8::1]:1234",
+			want: map[string]string{
+				"X-Forwarded-For": "2001:db8::1",
+				"Forwarded":       `for="[2001:db8::1]";host=proxy.test;proto=http`,
+			},
+		},
+		{
+			name: "disabled", remoteAddr: "192.0.2.1:1234",
+			want: map[string]string{"X-Forwarded-For": "", "Forwarded": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://proxy.test/"+encode(upstream.URL), nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.prior != "" {
+				req.Header.Set("X-Forwarded-For", tt.prior)
+			}
+			serve(newTestProxy(Options{ForwardClientIP: tt.enabled}), req)
+			for name, want := range tt.want {
+				if v := got.Get(name); v != want {
+					t.Errorf("%s = %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var got string
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+	})
+	tests := []struct {
+		name, override, want string
+	}{
+		{"forwarded", "", "client/1.0"},
+		{"overridden", "bot/2.0", "bot/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL), nil)
+			req.Header.Set("User-Agent", "client/1.0")
+			serve(newTestProxy(Options{UserAgent: tt.override}), req)
+			if got != tt.want {
+				t.Errorf("upstream User-Agent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddAndRemoveHeaders(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "ALLOWALL")
+		w.Header().Set("X-Powered-By", "PHP/5.6")
+		w.Header().Set("X-Kept", "1")
+	})
+	p := newTestProxy(Options{
+		AddHeaders: http.Header{
+			"X-Frame-Options": {"DENY"},
+			"Referrer-Policy": {"no-referrer"},
+		},
+		RemoveHeaders: []string{"x-powered-by"},
+	})
+	rec := get(p, upstream.URL, "")
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"X-Frame-Options", "DENY"},
+		{"Referrer-Policy", "no-referrer"},
+		{"X-Powered-By", ""},
+		{"X-Kept", "1"},
+	}
+	for _, tt := range tests {
+		if got := rec.Header().Values(tt.header); strings.Join(got, ", ") != tt.want {
+			t.Errorf("%s = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		query      string
+		wantHeader string
+		wantQuery  string
+	}{
+		{"disabled", false, "?h_Authorization=Bearer+x&a=1", "", "h_Authorization=Bearer+x&a=1"},
+		{"enabled", true, "?h_Authorization=Bearer+x&a=1", "Bearer x", "a=1"},
+		{"invalid name", true, "?h_Bad%20Name=x&a=1", "", "a=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotHeader, gotQuery string
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				gotHeader, gotQuery = r.Header.Get("Authorization"), r.URL.RawQuery
+			})
+			get(newTestProxy(Options{EnableHeaderInjection: tt.enabled}), upstream.URL, tt.query)
+			if gotHeader != tt.wantHeader {
+				t.Errorf("upstream Authorization = %q, want %q", gotHeader, tt.wantHeader)
+			}
+			if gotQuery != tt.wantQuery {
+				t.Errorf("upstream query = %q, want %q", gotQuery, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestUpstreamHost(t *testing.T) {
+	var got string
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Host
+	})
+	tests := []struct {
+		name         string
+		upstreamHost string
+		want         string
+	}{
+		{"from URL", "", strings.TrimPrefix(upstream.URL, "http://")},
+		{"override", "site.example", "site.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get(newTestProxy(Options{UpstreamHost: tt.upstreamHost}), upstream.URL, "")
+			if got != tt.want {
+				t.Errorf("upstream Host = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    []string
+		value string
+		want  []string
+	}{
+		{"empty", nil, "Origin", []string{"Origin"}},
+		{"list", []string{"Accept"}, "Accept-Encoding, Cookie", []string{"Accept", "Accept-Encoding", "Cookie"}},
+		{"already listed", []string{"accept-encoding, Origin"}, "Origin, Accept-Encoding", []string{"accept-encoding, Origin"}},
+		{"star", []string{"*"}, "Origin", []string{"*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{"Vary": tt.in}
+			addVary(h, tt.value)
+			if got := h.Values("Vary"); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("Vary = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVaryPassthrough(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Vary", "Accept-Language, Origin")
+		w.Write([]byte(`<a href="/next">next</a>`))
+	})
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"rewritten", Options{}, "Accept-Language, Origin"},
+		{"merged with CORS", Options{CORSOrigins: []string{"https://app.test"}}, "Origin, Accept-Language"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(newTestProxy(tt.opts), upstream.URL, "?browse=1")
+			if got := strings.Join(rec.Header().Values("Vary"), ", "); got != tt.want {
+				t.Errorf("Vary = %q, want %q", got, tt.want)
+			}
+			if !strings.Contains(rec.Body.String(), "?browse=1") {
+				t.Errorf("body = %q, want it rewritten", rec.Body.String())
+			}
+		})
+	}
+}
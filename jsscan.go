@@ -0,0 +1,201 @@
+package proxy
+
+import "strings"
+
+// regexKeywords are the keywords after which a "/" starts a regular
+// expression literal rather than a division.
+var regexKeywords = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true, "of": true,
+	"new": true, "delete": true, "void": true, "throw": true, "case": true,
+	"do": true, "else": true, "yield": true, "await": true,
+}
+
+// mapJSCode calls rewrite on each stretch of src that is ordinary code or
+// plain string literals, and copies comments, template literals and regular
+// expression literals through unchanged. It is a lightweight scanner, not a
+// parser: it only needs to tell those constructs apart well enough that URL
+// rewriting never reaches inside them.
+func mapJSCode(src string, rewrite func(string) string) string {
+	var out strings.Builder
+	start := 0 // start of the current code stretch
+	// prev is the last significant character outside comments, and word the
+	// identifier or keyword ending there, if any. Together they decide
+	// whether a "/" begins a regular expression.
+	var prev byte
+	var word string
+
+	skip := func(i, end int) {
+		out.WriteString(rewrite(src[start:i]))
+		out.WriteString(src[i:end])
+		start = end
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				end = len(src)
+			} else {
+				end += i
+			}
+			skip(i, end)
+			i = end
+			continue
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src)
+			} else {
+				end += i + 4
+			}
+			skip(i, end)
+			i = end
+			continue
+		case c == '"' || c == '\'':
+			i = skipJSString(src, i)
+			prev, word = c, ""
+			continue
+		case c == '`':
+			end := skipJSTemplate(src, i)
+			skip(i, end)
+			i = end
+			prev, word = c, ""
+			continue
+		case (c == '+' || c == '-') && i+1 < len(src) && src[i+1] == c && !regexAllowed(prev, word):
+			// A postfix increment or decrement leaves the expression
+			// ended, as its operand did, so prev and word are kept.
+			i += 2
+			continue
+		case c == '/' && regexAllowed(prev, word):
+			if end, ok := skipJSRegex(src, i); ok {
+				skip(i, end)
+				i = end
+				prev, word = '/', ""
+				continue
+			}
+		case isJSIdentByte(c):
+			end := i
+			for end < len(src) && isJSIdentByte(src[end]) {
+				end++
+			}
+			prev, word = src[end-1], src[i:end]
+			i = end
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		}
+		prev, word = c, ""
+		i++
+	}
+	out.WriteString(rewrite(src[start:]))
+	return out.String()
+}
+
+// regexAllowed reports whether a "/" following prev (and word, if prev ends
+// an identifier) starts a regular expression literal.
+func regexAllowed(prev byte, word string) bool {
+	if word != "" {
+		return regexKeywords[word]
+	}
+	switch prev {
+	case ')', ']', '}', '"', '\'', '`':
+		return false
+	}
+	return true
+}
+
+func isJSIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// skipJSString returns the index just past the string literal starting at
+// src[i]. An unterminated literal ends at the line break.
+func skipJSString(src string, i int) int {
+	quote := src[i]
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		case '\n':
+			return i
+		}
+	}
+	return len(src)
+}
+
+// skipJSTemplate returns the index just past the template literal starting
+// at src[i], including any ${...} substitutions and templates nested in them.
+func skipJSTemplate(src string, i int) int {
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '`':
+			return i + 1
+		case '$':
+			if i+1 < len(src) && src[i+1] == '{' {
+				i = skipJSSubstitution(src, i+2) - 1
+			}
+		}
+	}
+	return len(src)
+}
+
+// skipJSSubstitution returns the index just past the "}" closing a template
+// substitution whose body starts at src[i].
+func skipJSSubstitution(src string, i int) int {
+	depth := 1
+	for i < len(src) {
+		switch src[i] {
+		case '"', '\'':
+			i = skipJSString(src, i)
+			continue
+		case '`':
+			i = skipJSTemplate(src, i)
+			continue
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(src)
+}
+
+// skipJSRegex returns the index just past the regular expression literal,
+// flags included, starting at src[i]. It reports false if the literal does
+// not end on the same line, in which case the "/" was not a regex after all.
+func skipJSRegex(src string, i int) (int, bool) {
+	inClass := false
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if !inClass {
+				i++
+				for i < len(src) && isJSIdentByte(src[i]) {
+					i++
+				}
+				return i, true
+			}
+		case '\n', '\r':
+			return 0, false
+		}
+	}
+	return 0, false
+}
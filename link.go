@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteLinkHeaders routes the URL of every Link header value, such as a
+// preload or preconnect hint, through the proxy. Parameters like rel, as and
+// crossorigin are kept as they are.
+func rewriteLinkHeaders(h http.Header, base *url.URL, opts *rewriteOptions) {
+	values := h.Values("Link")
+	if len(values) == 0 {
+		return
+	}
+	rewritten := make([]string, len(values))
+	for i, value := range values {
+		rewritten[i] = rewriteLink(value, base, opts)
+	}
+	h["Link"] = rewritten
+}
+
+// rewriteLink rewrites the URL references in one Link header value, which
+// may hold several comma-separated links of the form <url>; param=value.
+// A value that doesn't parse is returned unchanged.
+func rewriteLink(value string, base *url.URL, opts *rewriteOptions) string {
+	var out strings.Builder
+	for rest := value; rest != ""; {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			out.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '>')
+		if end < 0 {
+			return value
+		}
+		end += start
+		out.WriteString(rest[:start+1])
+		ref := rest[start+1 : end]
+		if resolved, err := resolveURL(base, ref); err == nil {
+			out.WriteString(opts.proxyURL(resolved))
+		} else {
+			out.WriteString(ref)
+		}
+
+		// Copy the parameters up to the comma ending this link, skipping
+		// over quoted strings, which may contain commas or angle brackets.
+		rest = rest[end:]
+		next := linkParamsEnd(rest)
+		out.WriteString(rest[:next])
+		rest = rest[next:]
+	}
+	return out.String()
+}
+
+// linkParamsEnd returns the index just past the comma that ends the link
+// parameters at the start of s, or len(s).
+func linkParamsEnd(s string) int {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case inQuotes && c == '\\':
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && c == ',':
+			return i + 1
+		}
+	}
+	return len(s)
+}
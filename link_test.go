@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteLink(t *testing.T) {
+	base := mustParse(t, "https://example.com/dir/page.html")
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			"preload",
+			"</style.css>; rel=preload; as=style",
+			"<" + proxied("https://example.com/style.css") + ">; rel=preload; as=style",
+		},
+		{
+			"several links",
+			"<https://cdn.example.com>; rel=preconnect; crossorigin, <font.woff2>; rel=preload; as=font",
+			"<" + proxied("https://cdn.example.com") + ">; rel=preconnect; crossorigin, <" + proxied("https://example.com/dir/font.woff2") + ">; rel=preload; as=font",
+		},
+		{
+			"quoted parameter",
+			`</a>; title="x, <y>", </b>; rel=next`,
+			"<" + proxied("https://example.com/a") + `>; title="x, <y>", <` + proxied("https://example.com/b") + ">; rel=next",
+		},
+		{"unterminated", "</a; rel=preload", "</a; rel=preload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteLink(tt.in, base, testOptions()); got != tt.want {
+				t.Errorf("rewriteLink(%q) =\n%q, want\n%q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteLinkHeaders(t *testing.T) {
+	h := http.Header{"Link": {"</a.js>; rel=preload; as=script", "</b.css>; rel=preload; as=style"}}
+	rewriteLinkHeaders(h, mustParse(t, "https://example.com/"), testOptions())
+	want := []string{
+		"<" + proxied("https://example.com/a.js") + ">; rel=preload; as=script",
+		"<" + proxied("https://example.com/b.css") + ">; rel=preload; as=style",
+	}
+	if got := h.Values("Link"); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Link = %q, want %q", got, want)
+	}
+}
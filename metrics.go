@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served at /metrics.
+var (
+	requestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Total number of proxy requests received.",
+	})
+	inFlightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_in_flight_requests",
+		Help: "Number of proxy requests currently being served.",
+	})
+	upstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_responses_total",
+		Help: "Upstream responses by status class (2xx, 3xx, ...), or \"error\" when no response was received.",
+	}, []string{"class"})
+	upstreamDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proxy_upstream_duration_seconds",
+		Help:    "Time until the upstream response headers were received.",
+		Buckets: prometheus.DefBuckets,
+	})
+	rewriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_rewrite_duration_seconds",
+		Help:    "Time spent rewriting response bodies, by content type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"content_type"})
+)
+
+// statusClass returns the metric label for an HTTP status code, e.g. "2xx".
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// serverTiming formats one Server-Timing metric, e.g. "upstream;dur=12.3",
+// with the duration in milliseconds.
+func serverTiming(name string, d time.Duration) string {
+	return name + ";dur=" + strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
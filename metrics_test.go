@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStatusClass(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{200, "2xx"}, {302, "3xx"}, {404, "4xx"}, {503, "5xx"},
+	}
+	for _, tt := range tests {
+		if got := statusClass(tt.code); got != tt.want {
+			t.Errorf("statusClass(%d) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsCountRequests(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	p := newTestProxy(Options{})
+	requests := testutil.ToFloat64(requestsTotal)
+	notFound := testutil.ToFloat64(upstreamResponses.WithLabelValues("4xx"))
+	get(p, upstream.URL, "")
+	if got := testutil.ToFloat64(requestsTotal) - requests; got != 1 {
+		t.Errorf("proxy_requests_total grew by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(upstreamResponses.WithLabelValues("4xx")) - notFound; got != 1 {
+		t.Errorf(`proxy_upstream_responses_total{class="4xx"} grew by %v, want 1`, got)
+	}
+	if got := testutil.ToFloat64(inFlightRequests); got != 0 {
+		t.Errorf("proxy_in_flight_requests = %v, want 0", got)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	if got, want := serverTiming("rewrite", 1234567*time.Nanosecond), "rewrite;dur=1.2"; got != want {
+		t.Errorf("serverTiming = %q, want %q", got, want)
+	}
+
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		io.WriteString(w, "<p>hi</p>")
+	})
+	tests := []struct {
+		name, contentType, query string
+		want                     string
+	}{
+		{"rewritten", "text/html", "?browse=1", `^upstream;dur=\d+\.\d, rewrite;dur=\d+\.\d$`},
+		{"streamed", "image/png", "?browse=1", `^upstream;dur=\d+\.\d$`},
+		{"not browsing", "text/html", "", `^$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(newTestProxy(Options{}), upstream.URL+"/?type="+tt.contentType, tt.query)
+			if got := rec.Header().Get("Server-Timing"); !regexp.MustCompile(tt.want).MatchString(got) {
+				t.Errorf("Server-Timing = %q, want a match for %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1118 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+)
+
+// statusClientClosedRequest is the non-standard status (from nginx) recorded
+// when the client disconnects before the upstream responds.
+const statusClientClosedRequest = 499
+
+// Logger receives the proxy's log messages. *log.Logger satisfies it, and
+// adapters for structured loggers need only this one method.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Options configures a Proxy. The zero value is a working proxy mounted at
+// "/" that refuses internal upstream addresses.
+type Options struct {
+	// Client sends the upstream requests. If nil, NewProxy builds one with
+	// UpstreamTimeout whose dialer refuses internal addresses unless
+	// AllowPrivate is set, caching responses if CacheBytes is set. A custom
+	// Client is used as is: upstream hosts are still checked before each
+	// request, but the addresses it dials are not.
+	Client *http.Client
+	// UpstreamTimeout is the total timeout for each upstream request made
+	// by the default Client, retries included. It defaults to 30 seconds.
+	// Server-sent event streams are exempt once their headers arrive.
+	UpstreamTimeout time.Duration
+	// UpstreamTimeouts overrides UpstreamTimeout for upstreams on the given
+	// domains, which also match their subdomains, as in DenyHosts. The most
+	// specific domain wins. They apply to a custom Client too, within its
+	// own Timeout.
+	UpstreamTimeouts map[string]time.Duration
+	// CacheBytes, if positive, is the size of the default Client's
+	// in-memory cache for cacheable GET responses.
+	CacheBytes int64
+	// InsecureUpstream disables verification of upstream TLS certificates.
+	// It is meant for internal upstreams with self-signed certificates.
+	InsecureUpstream bool
+	// UpstreamCAs, if set, replaces the system roots used to verify
+	// upstream TLS certificates.
+	UpstreamCAs *x509.CertPool
+	// FollowRedirects makes the default Client follow upstream redirects,
+	// rewriting the final response against the URL it came from. Otherwise
+	// redirects are passed to the client, with Location routed through the
+	// proxy in browse mode.
+	FollowRedirects bool
+	// MaxRetries is how many times an upstream request is retried after a
+	// connection error. Only GET, HEAD and OPTIONS requests are retried
+	// after any error; other methods are retried only when no connection
+	// could be made, so the upstream never saw them. Requests with a body
+	// are retried only if it was buffered, as set by MaxBufferBody.
+	MaxRetries int
+	// UpstreamProxy, if set, is an http, https or socks5 proxy that all
+	// upstream connections go through. With an HTTP proxy, WebSocket and
+	// CONNECT tunnels still dial upstreams directly.
+	UpstreamProxy *url.URL
+	// DialContext, if set, opens the connections to upstreams, or to a
+	// socks5 UpstreamProxy, in place of a direct dial. The addresses it
+	// dials are not checked; upstream hosts still are before each request.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// MaxRequestBody, if positive, is the largest request body passed
+	// upstream. Larger ones are answered with 413 Content Too Large.
+	MaxRequestBody int64
+	// MaxBufferBody, if positive, is the largest request body that is
+	// buffered, so that it can be sent again when the request is retried or
+	// a 307 or 308 redirect is followed. Larger bodies are streamed and
+	// their requests never retried.
+	MaxBufferBody int64
+	// BlockContentTypes lists media types of upstream responses that are
+	// refused with BlockStatus instead of being passed on. An entry such as
+	// "video/*" matches every subtype. BlockStatus defaults to 403
+	// Forbidden.
+	BlockContentTypes []string
+	BlockStatus       int
+
+	// MaxConcurrent, if positive, caps how many requests are proxied at
+	// once. Requests beyond it are answered with 503 Service Unavailable.
+	MaxConcurrent int
+	// BreakerFailures, if positive, opens a host's circuit after that many
+	// consecutive failed upstream requests within BreakerWindow: requests to
+	// the host are answered with 503 Service Unavailable for
+	// BreakerCooldown, after which one request probes whether it recovered.
+	// Only connection errors and timeouts count as failures, not error
+	// responses.
+	BreakerFailures int
+	// BreakerWindow defaults to one minute and BreakerCooldown to 30
+	// seconds.
+	BreakerWindow   time.Duration
+	BreakerCooldown time.Duration
+
+	// AllowPrivate allows upstreams on loopback, private, and link-local
+	// addresses.
+	AllowPrivate bool
+	// DenyHosts lists domains that may never be proxied, whatever they
+	// resolve to. Each entry also matches its subdomains and may be written
+	// as "example.com", ".example.com", or "*.example.com".
+	DenyHosts []string
+	// EnableConnect lets clients use the proxy as a general forward proxy
+	// through the CONNECT method.
+	EnableConnect bool
+	// EnableForwardProxy proxies requests with an absolute-form target, as
+	// in "GET http://example.com/ HTTP/1.1", to that URL, the way HTTP
+	// clients configured with a forward proxy send them. They authenticate
+	// with Proxy-Authorization and are never rewritten.
+	EnableForwardProxy bool
+	// AuthUser and AuthPass, when set, protect the proxy with HTTP Basic
+	// Auth.
+	AuthUser, AuthPass string
+	// CORSOrigins lists the origins allowed to call the proxy from a
+	// browser, with credentials, or "*" for any origin, without them. When
+	// empty, CORS is left entirely to the upstream.
+	CORSOrigins []string
+
+	// BasePath is the path the proxy is mounted at. It defaults to "/".
+	BasePath string
+	// MaxURLLength is the longest encoded URL, with any path after it, that
+	// is decoded. Longer ones are answered with 414 URI Too Long. It
+	// defaults to 8 KiB.
+	MaxURLLength int
+	// DefaultScheme, if set, is prepended to decoded upstream URLs that
+	// have no scheme, such as "example.com/path". Such URLs are rejected
+	// otherwise.
+	DefaultScheme string
+	// BrowseParam is the query parameter that turns on browse mode. It
+	// defaults to "browse".
+	BrowseParam string
+	// FlushInterval, if positive, is how long streamed response data may
+	// sit in the server's buffers before it is flushed to the client. If
+	// negative, it is flushed after every read from the upstream. Zero
+	// leaves flushing to the server. Server-sent events always get flushed
+	// after every read.
+	FlushInterval time.Duration
+	// MaxRewriteBytes caps how much of an upstream body is buffered for
+	// rewriting; larger bodies are streamed unrewritten. It defaults to
+	// 10 MiB.
+	MaxRewriteBytes int64
+	// RewriteJSON enables rewriting of URLs in JSON responses in browse
+	// mode. It is off by default because it can break API clients.
+	RewriteJSON bool
+	// RewriteAJAX rewrites root-relative URLs passed to common AJAX helpers
+	// in JavaScript, such as axios.get("/api") and $.ajax({url: "/api"}).
+	// It is off by default because the patterns can misfire.
+	RewriteAJAX bool
+	// RewriteTypes maps additional media types, such as
+	// "application/vnd.example+html", to the rewriter used for them in
+	// browse mode: "html", "css", "javascript", "json", "xml" or
+	// "manifest". An empty name turns rewriting off for a type that is
+	// rewritten by default.
+	RewriteTypes map[string]string
+	// SameOriginOnly limits the rewriting of HTML in browse mode, inline
+	// styles and scripts included, to URLs on the page's host. Links and
+	// subresources elsewhere, such as on CDNs, are left to load directly.
+	SameOriginOnly bool
+	// ExtraURLAttrs maps element names, such as "amp-img", to attributes
+	// holding URLs that are rewritten in HTML in browse mode, in addition
+	// to standard ones like href and src.
+	ExtraURLAttrs map[string][]string
+	// CompressOutput gzips rewritten bodies for clients that accept gzip.
+	// Browse mode asks upstreams for uncompressed bodies to rewrite, so
+	// they are otherwise sent uncompressed.
+	CompressOutput bool
+	// SniffContent detects the type of responses without a Content-Type,
+	// or with a generic one like application/octet-stream, from their
+	// first bytes in browse mode, so misdeclared HTML is still rewritten.
+	SniffContent bool
+	// RewriteFallback serves a body that fails to rewrite as it came from
+	// the upstream instead of answering with an error.
+	RewriteFallback bool
+	// StripCSP removes Content-Security-Policy headers in browse mode
+	// instead of rewriting them.
+	StripCSP bool
+
+	// AddHeaders are set on every proxied response, replacing the
+	// upstream's values, and RemoveHeaders are deleted from it. They are
+	// applied after the proxy's own changes, removals first.
+	AddHeaders    http.Header
+	RemoveHeaders []string
+	// BlockRobots asks search engines not to index proxied pages, with an
+	// X-Robots-Tag header on every proxied response. Serve ServeRobots at
+	// /robots.txt along with it.
+	BlockRobots bool
+
+	// EnableHeaderInjection turns query parameters of the proxy URL named
+	// h_Name into upstream request headers, as a debugging aid: ?h_X-Custom=1
+	// sends "X-Custom: 1" and replaces any such header of the client. They
+	// are removed from the upstream query.
+	EnableHeaderInjection bool
+	// ForwardClientIP tells upstreams about the client through the
+	// X-Forwarded-* and Forwarded headers. It is off by default so clients
+	// stay anonymous.
+	ForwardClientIP bool
+	// UpstreamHost, if set, is the Host header of every upstream request
+	// instead of the host of the decoded URL, for upstreams addressed by IP
+	// that serve virtual hosts. Upstream TLS certificates are verified
+	// against it too.
+	UpstreamHost string
+	// UserAgent, when set, replaces the client's User-Agent on upstream
+	// requests.
+	UserAgent string
+
+	// ErrorTemplate, if set, renders the HTML pages of the proxy's own
+	// error responses, such as a 502 for an unreachable upstream, in place
+	// of plain text. It is executed with an ErrorPage.
+	ErrorTemplate *template.Template
+
+	// Logger receives the proxy's log messages. It defaults to
+	// log.Default().
+	Logger Logger
+	// AccessLog, when set, receives one JSON object per request in place
+	// of the plain-text request log lines.
+	AccessLog io.Writer
+}
+
+// Proxy is an http.Handler that serves upstream URLs encoded in the request
+// path. Its Prometheus metrics are registered globally and shared by all
+// Proxies in a process.
+type Proxy struct {
+	Options
+	handler    http.Handler
+	rewriters  map[string]*contentRewriter // by media type
+	extraAttrs map[string]map[string]bool  // ExtraURLAttrs as sets, lowercased
+	sem        chan struct{}               // one slot per concurrent request, if MaxConcurrent is set
+	stats      *stats
+	dial       dialFunc // opens upstream connections
+	breaker    *breaker // if BreakerFailures is set
+	// defaultClient is whether Client was built by NewProxy, which leaves
+	// UpstreamTimeout to the request context.
+	defaultClient bool
+}
+
+// NewProxy returns a Proxy configured by opts, filling in defaults for
+// unset options.
+func NewProxy(opts Options) *Proxy {
+	p := &Proxy{Options: opts}
+	if p.BasePath = "/" + strings.Trim(p.BasePath, "/") + "/"; p.BasePath == "//" {
+		p.BasePath = "/"
+	}
+	if p.BrowseParam == "" {
+		p.BrowseParam = "browse"
+	}
+	if p.MaxURLLength <= 0 {
+		p.MaxURLLength = 8 << 10
+	}
+	if p.MaxRewriteBytes <= 0 {
+		p.MaxRewriteBytes = 10 << 20
+	}
+	if p.BlockStatus == 0 {
+		p.BlockStatus = http.StatusForbidden
+	}
+	if p.UpstreamTimeout <= 0 {
+		p.UpstreamTimeout = 30 * time.Second
+	}
+	if p.Logger == nil {
+		p.Logger = log.Default()
+	}
+	p.DenyHosts = normalizeDenyHosts(p.DenyHosts)
+	if len(p.UpstreamTimeouts) > 0 {
+		timeouts := make(map[string]time.Duration, len(p.UpstreamTimeouts))
+		for domain, timeout := range p.UpstreamTimeouts {
+			timeouts[normalizeDomain(domain)] = timeout
+		}
+		p.UpstreamTimeouts = timeouts
+	}
+	p.rewriters = p.buildRewriters()
+	p.extraAttrs = attrSets(p.ExtraURLAttrs)
+	p.stats = newStats()
+	p.dial = p.upstreamDialer()
+	if p.Client == nil {
+		var transport http.RoundTripper = p.newTransport()
+		if p.CacheBytes > 0 {
+			transport = newCachingTransport(transport, p.CacheBytes)
+		}
+		p.Client = &http.Client{Transport: transport, CheckRedirect: p.checkRedirect}
+		p.defaultClient = true
+	}
+
+	if p.MaxConcurrent > 0 {
+		p.sem = make(chan struct{}, p.MaxConcurrent)
+	}
+	if p.BreakerFailures > 0 {
+		if p.BreakerWindow <= 0 {
+			p.BreakerWindow = time.Minute
+		}
+		if p.BreakerCooldown <= 0 {
+			p.BreakerCooldown = 30 * time.Second
+		}
+		p.breaker = newBreaker(p.BreakerFailures, p.BreakerWindow, p.BreakerCooldown)
+	}
+
+	p.handler = http.HandlerFunc(p.serve)
+	if p.AccessLog != nil {
+		p.handler = withAccessLog(p.handler, p.AccessLog, p.Logger)
+	}
+	p.handler = withRequestID(p.handler)
+	return p
+}
+
+// ServeHTTP proxies r to the upstream URL encoded in its path, or opens a
+// tunnel for a CONNECT request. Note that http.ServeMux never routes CONNECT
+// requests, so a Proxy that should handle them must see them first.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// serve dispatches r to the CONNECT tunnel or the HTTP proxy.
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request) {
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+			defer func() { <-p.sem }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			p.httpError(w, "", "Too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if r.Method == http.MethodConnect {
+		p.proxyConnect(w, r)
+		return
+	}
+	p.proxyHTTP(w, r)
+}
+
+// proxyHTTP proxies a plain HTTP or WebSocket request.
+func (p *Proxy) proxyHTTP(w http.ResponseWriter, r *http.Request) {
+	requestsTotal.Inc()
+	inFlightRequests.Inc()
+	defer inFlightRequests.Dec()
+	defer p.stats.begin()()
+	logger := p.logger(r.Context())
+
+	// Preflights carry no credentials, so they are answered before the
+	// auth check.
+	if len(p.CORSOrigins) > 0 {
+		if isPreflight(r) {
+			p.handlePreflight(w, r)
+			return
+		}
+		p.setCORSHeaders(w.Header(), r)
+	}
+
+	forward := p.EnableForwardProxy && r.URL.IsAbs()
+	if forward && !p.checkProxyAuth(w, r) || !forward && !p.checkAuth(w, r) {
+		return
+	}
+
+	var parsedURL *url.URL
+	var injectedHeaders http.Header
+	if forward {
+		// An absolute-form request target, as sent to a forward proxy,
+		// names the upstream itself.
+		if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+			p.httpError(w, r.URL.String(), "Unsupported scheme: "+r.URL.Scheme, http.StatusBadRequest)
+			return
+		}
+		target := *r.URL
+		parsedURL = &target
+	} else {
+		var ok bool
+		if parsedURL, injectedHeaders, ok = p.upstreamFromPath(w, r); !ok {
+			return
+		}
+	}
+	upstreamURL := parsedURL.String()
+
+	// Refuse to reach internal addresses.
+	if err := p.checkUpstreamHost(r.Context(), parsedURL.Hostname()); err != nil {
+		logger.Printf("Blocked upstream %s: %v", parsedURL.Host, err)
+		p.httpError(w, upstreamURL, "Upstream host is not allowed: "+parsedURL.Hostname(), http.StatusForbidden)
+		return
+	}
+
+	p.stats.countHost(parsedURL.Host)
+
+	// Log the incoming request.
+	logUpstream(r, upstreamURL, 0)
+	if p.AccessLog == nil {
+		logger.Printf("Incoming request: %s %s from %s, proxying to %s", r.Method, r.URL.String(), r.RemoteAddr, upstreamURL)
+	}
+
+	// WebSocket upgrades can't go through the HTTP client, so tunnel them.
+	if isWebSocketUpgrade(r) {
+		p.proxyWebSocket(w, r, parsedURL, forward, injectedHeaders)
+		return
+	}
+
+	// Fail fast while the upstream host's circuit is open.
+	if p.breaker != nil {
+		wait, ok := p.breaker.allow(parsedURL.Host)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			p.httpError(w, upstreamURL, "Upstream host is failing: "+parsedURL.Hostname(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// Determine if the browse query parameter is set.
+	browseEnabled := !forward && r.URL.Query().Get(p.BrowseParam) != ""
+
+	// Refuse oversized uploads, up front if the client declared the size.
+	// Otherwise the upload fails once it exceeds the limit. An empty body
+	// is left as http.NoBody, which lets a request without one be retried.
+	if p.MaxRequestBody > 0 {
+		if r.ContentLength > p.MaxRequestBody {
+			p.httpError(w, upstreamURL, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, p.MaxRequestBody)
+		}
+	}
+
+	// Buffer small request bodies so that a retry, or a followed redirect
+	// that keeps the body, can send them again. Larger ones are streamed.
+	var body io.Reader = r.Body
+	buffered := false
+	if p.MaxBufferBody > 0 && r.Body != nil && r.Body != http.NoBody && r.ContentLength <= p.MaxBufferBody {
+		data, err := io.ReadAll(io.LimitReader(r.Body, p.MaxBufferBody+1))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			p.httpError(w, upstreamURL, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			p.httpError(w, upstreamURL, "Error reading request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(data)) > p.MaxBufferBody {
+			body = io.MultiReader(bytes.NewReader(data), r.Body)
+		} else {
+			body, buffered = bytes.NewReader(data), true
+		}
+	}
+
+	// The timeout covers the response body too, which is copied before
+	// proxyHTTP returns, except for server-sent events: an event stream is
+	// meant to stay open, so its timer is stopped once the headers arrive.
+	ctx := r.Context()
+	stopTimeout := func() bool { return false }
+	if timeout := p.upstreamTimeout(parsedURL.Hostname()); timeout > 0 {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		stopTimeout = time.AfterFunc(timeout, func() { cancel(context.DeadlineExceeded) }).Stop
+	}
+
+	// Create a new request to the upstream server.
+	// Note: unless it was buffered, r.Body is streamed to the upstream.
+	// Tying it to the incoming request's context cancels it if the client goes away.
+	req, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL, body)
+	if err != nil {
+		p.httpError(w, upstreamURL, "Failed to create upstream request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// NewRequest can't tell the length of a streamed body, so without this
+	// every request body, from an upload or a PUT, PATCH or DELETE, would be
+	// sent chunked, which some servers reject. A body the client sent
+	// chunked stays chunked. A buffered body is sent with its length.
+	if !buffered {
+		req.ContentLength = r.ContentLength
+		req.TransferEncoding = r.TransferEncoding
+	}
+
+	p.setUpstreamHeaders(req, r, forward, browseEnabled, injectedHeaders)
+	// Browse mode rewrites the response, so it has the transport ask for,
+	// and decode, the encodings it supports.
+	if browseEnabled {
+		req.Header.Del("Accept-Encoding")
+	}
+
+	// Send the request upstream.
+	start := time.Now()
+	resp, err := p.doUpstream(req)
+	upstreamElapsed := time.Since(start)
+	upstreamDuration.Observe(upstreamElapsed.Seconds())
+	if err != nil {
+		upstreamResponses.WithLabelValues("error").Inc()
+		var netErr net.Error
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			p.httpError(w, upstreamURL, "Request body too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errBlockedAddress):
+			logger.Printf("Blocked upstream %s: %v", parsedURL.Host, err)
+			p.httpError(w, upstreamURL, "Upstream host is not allowed: "+parsedURL.Hostname(), http.StatusForbidden)
+		case errors.Is(r.Context().Err(), context.Canceled):
+			// Nobody is left to read this; the status is for logs and metrics.
+			p.httpError(w, upstreamURL, "Client closed request", statusClientClosedRequest)
+		case errors.Is(err, context.DeadlineExceeded), errors.Is(context.Cause(ctx), context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+			p.recordUpstream(parsedURL.Host, true)
+			p.httpError(w, upstreamURL, "Upstream request timed out: "+err.Error(), http.StatusGatewayTimeout)
+		default:
+			p.recordUpstream(parsedURL.Host, true)
+			p.httpError(w, upstreamURL, "Upstream request failed: "+err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	p.recordUpstream(parsedURL.Host, false)
+	defer resp.Body.Close()
+
+	upstreamResponses.WithLabelValues(statusClass(resp.StatusCode)).Inc()
+
+	// Relative URLs in the response resolve against where it actually came
+	// from, which differs from the decoded URL after followed redirects.
+	baseURL := parsedURL
+	if resp.Request != nil && resp.Request.URL != nil {
+		baseURL = resp.Request.URL
+	}
+
+	// Log the upstream response status.
+	logUpstream(r, upstreamURL, resp.StatusCode)
+	if p.AccessLog == nil {
+		logger.Printf("Upstream response: %d for %s", resp.StatusCode, upstreamURL)
+	}
+
+	// Refuse blocked types before any of the body is read.
+	if contentTypeBlocked(resp.Header.Get("Content-Type"), p.BlockContentTypes) {
+		logger.Printf("Blocked %s from %s", mediaType(resp.Header.Get("Content-Type")), upstreamURL)
+		p.httpError(w, upstreamURL, "Upstream content type is not allowed: "+mediaType(resp.Header.Get("Content-Type")), p.BlockStatus)
+		return
+	}
+
+	opts := p.rewriteOptions(r)
+	origin := opts.origin
+
+	// Keep redirects inside the proxy by rewriting the Location header.
+	if browseEnabled && isRedirect(resp.StatusCode) {
+		if location := resp.Header.Get("Location"); location != "" {
+			if resolved, err := resolveURL(baseURL, location); err == nil {
+				resp.Header.Set("Location", opts.proxyURL(resolved))
+			}
+		}
+	}
+
+	// Scope upstream cookies to the proxy so the browser keeps them, let
+	// the page's CSP allow resources that now come from the proxy, and keep
+	// preload hints and Refresh redirects from going straight upstream.
+	if browseEnabled {
+		rewriteSetCookies(resp.Header, baseURL.Hostname())
+		rewriteCSPHeaders(resp.Header, origin, p.StripCSP)
+		rewriteLinkHeaders(resp.Header, baseURL, opts)
+		if refresh := resp.Header.Get("Refresh"); refresh != "" {
+			resp.Header.Set("Refresh", rewriteRefresh(refresh, baseURL, opts))
+		}
+	}
+
+	removeHopHeaders(resp.Header)
+	if len(p.CORSOrigins) > 0 {
+		removeCORSHeaders(resp.Header)
+	}
+
+	// Decide once whether the body is rewritten. Only rewritten bodies are
+	// buffered; everything else, such as images and video, is streamed.
+	// Server-sent events are never buffered, even if a rewriter is
+	// configured for them, and each chunk is flushed as it arrives.
+	eventStream := mediaType(resp.Header.Get("Content-Type")) == "text/event-stream"
+	if eventStream {
+		stopTimeout()
+	}
+	var rewriter *contentRewriter
+	if browseEnabled && !eventStream {
+		if p.SniffContent && r.Method != http.MethodHead {
+			sniffContentType(resp)
+		}
+		rewriter = p.rewriterFor(resp.Header.Get("Content-Type"))
+	}
+	// A partial response can't be rewritten, and its Content-Length and
+	// Content-Range must match the bytes sent, which media players rely on
+	// when seeking.
+	if rewriter != nil && (resp.StatusCode == http.StatusPartialContent || r.Header.Get("Range") != "") {
+		rewriter = nil
+	}
+	// A HEAD response has no body to rewrite. Its headers still describe
+	// the GET response, whose length changes when it is rewritten.
+	if rewriter != nil && r.Method == http.MethodHead {
+		resp.Header.Del("Content-Length")
+		rewriter = nil
+	}
+	// Nor do 204 and 304 responses. A 304's headers, ETag included, are
+	// passed on unchanged for the client to revalidate its cached copy.
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		rewriter = nil
+	}
+
+	// In browse mode, report where the time went in browser devtools.
+	var timings []string
+	if browseEnabled {
+		timings = append(timings, serverTiming("upstream", upstreamElapsed))
+	}
+
+	// Helper function to send the response headers, excluding Content-Length
+	// when the body is rewritten since its length changes. The upstream's
+	// Vary is kept, rewritten or not, so caches in front of the proxy keep
+	// telling its variants apart; it is merged with the proxy's own, such
+	// as Origin for CORS.
+	writeHeader := func() {
+		for key, values := range resp.Header {
+			if rewriter != nil && strings.ToLower(key) == "content-length" {
+				continue
+			}
+			if strings.ToLower(key) == "vary" {
+				for _, value := range values {
+					addVary(w.Header(), value)
+				}
+				continue
+			}
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+		if len(timings) > 0 {
+			w.Header().Add("Server-Timing", strings.Join(timings, ", "))
+		}
+		if p.BlockRobots {
+			w.Header().Set("X-Robots-Tag", robotsTag)
+		}
+		for _, key := range p.RemoveHeaders {
+			w.Header().Del(key)
+		}
+		for key, values := range p.AddHeaders {
+			w.Header()[http.CanonicalHeaderKey(key)] = values
+		}
+		// Upstream trailers are announced here and sent after the body
+		// by writeTrailers.
+		for key := range resp.Trailer {
+			w.Header().Add("Trailer", key)
+		}
+		w.WriteHeader(resp.StatusCode)
+	}
+
+	// Helper function to send the upstream trailers, which are known once
+	// its body has been read to the end.
+	writeTrailers := func() {
+		for key, values := range resp.Trailer {
+			w.Header()[key] = values
+		}
+	}
+
+	// Helper function to stream a body to the client unchanged.
+	streamBody := func(body io.Reader) {
+		writeHeader()
+		var dst io.Writer = w
+		var flush func() error
+		switch {
+		case eventStream:
+			flush = http.NewResponseController(w).Flush
+			flush()
+		case p.FlushInterval < 0:
+			flush = http.NewResponseController(w).Flush
+		case p.FlushInterval > 0:
+			lw := newLatencyWriter(w, http.NewResponseController(w).Flush, p.FlushInterval)
+			defer lw.stop()
+			dst = lw
+		}
+		err := copyBody(r.Context(), dst, body, flush)
+		if err == nil {
+			writeTrailers()
+		}
+		switch {
+		case err != nil && r.Context().Err() != nil:
+			logger.Printf("Client went away while streaming %s", upstreamURL)
+		case err != nil:
+			logger.Printf("Error streaming response: %v", err)
+		}
+	}
+
+	if rewriter == nil {
+		streamBody(resp.Body)
+		return
+	}
+
+	bodyBytes, rest, err := readBody(resp, p.MaxRewriteBytes)
+	if errors.Is(err, errBodyTooLarge) {
+		logger.Printf("Not rewriting %s from %s: %v", rewriter.name, upstreamURL, err)
+		streamBody(rest)
+		return
+	}
+	if err != nil {
+		p.httpError(w, upstreamURL, "Error reading upstream "+rewriter.name+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if rewriter == htmlRewriter {
+		contentType := resp.Header.Get("Content-Type")
+		bodyBytes, err = htmlToUTF8(bodyBytes, contentType)
+		if err != nil {
+			p.httpError(w, upstreamURL, "Error decoding upstream HTML: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		resp.Header.Set("Content-Type", mediaType(contentType)+"; charset=utf-8")
+	}
+	rewriteStart := time.Now()
+	rewritten, err := rewriter.rewrite(bodyBytes, baseURL, opts)
+	rewriteElapsed := time.Since(rewriteStart)
+	rewriteDuration.WithLabelValues(strings.ToLower(rewriter.name)).Observe(rewriteElapsed.Seconds())
+	if err != nil && p.RewriteFallback {
+		logger.Printf("Error rewriting %s from %s, serving it unrewritten: %v", rewriter.name, upstreamURL, err)
+		rewritten = bodyBytes
+	} else if err != nil {
+		p.httpError(w, upstreamURL, "Error rewriting "+rewriter.name+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	timings = append(timings, serverTiming("rewrite", rewriteElapsed))
+	if p.CompressOutput && acceptsGzip(r.Header) {
+		resp.Header.Set("Content-Encoding", "gzip")
+		addVary(resp.Header, "Accept-Encoding")
+		writeHeader()
+		gz := gzip.NewWriter(w)
+		_, err := gz.Write(rewritten)
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			logger.Printf("Error writing gzipped response for %s: %v", upstreamURL, err)
+		}
+		writeTrailers()
+		return
+	}
+	writeHeader()
+	w.Write(rewritten)
+	writeTrailers()
+}
+
+// rewriteOptions returns the options for rewriting a response to r, whose
+// Host makes up the proxy origin.
+func (p *Proxy) rewriteOptions(r *http.Request) *rewriteOptions {
+	origin := "http://" + r.Host
+	if r.TLS != nil {
+		origin = "https://" + r.Host
+	}
+	return &rewriteOptions{
+		origin:         origin,
+		basePath:       p.BasePath,
+		browseParam:    p.BrowseParam,
+		logger:         p.logger(r.Context()),
+		rewriteAJAX:    p.RewriteAJAX,
+		sameOriginOnly: p.SameOriginOnly,
+		extraAttrs:     p.extraAttrs,
+	}
+}
+
+// setUpstreamHeaders sets the headers of req, the upstream request for r.
+// All of the client's headers are copied except Host and the hop-by-hop
+// headers; request headers such as Content-Type, boundary included, are
+// never rewritten. Unless forward is set, cookies scoped to other upstreams
+// and the proxy's own credentials are dropped, as are the client's unscoped
+// cookies in browse mode. Then the header policy applies: the forwarding
+// headers, the User-Agent and Host overrides, and last the headers injected
+// through the query.
+func (p *Proxy) setUpstreamHeaders(req, r *http.Request, forward, browse bool, injected http.Header) {
+	for key, values := range r.Header {
+		if strings.ToLower(key) == "host" {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	removeHopHeaders(req.Header)
+	// Browse mode keeps every upstream's cookies on the proxy origin, so
+	// only those scoped to this upstream are sent to it. Outside it, those
+	// scoped to others are still held back.
+	if !forward {
+		scopeRequestCookies(req.Header, req.URL.Hostname(), !browse)
+	}
+	// The proxy's own credentials are not meant for the upstream. Forward
+	// proxy requests carry them in Proxy-Authorization, which is already
+	// gone.
+	if p.AuthUser != "" && !forward {
+		req.Header.Del("Authorization")
+	}
+	if p.ForwardClientIP {
+		setForwardedHeaders(req, r)
+	}
+	if p.UserAgent != "" {
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+	if p.UpstreamHost != "" {
+		req.Host = p.UpstreamHost
+	}
+	for key, values := range injected {
+		req.Header[key] = values
+	}
+}
+
+// upstreamFromPath decodes the upstream URL from the path of r, or takes it
+// from its url query parameter, adding the query parameters of r that
+// belong to the upstream, and returns the headers injected through the
+// query, if any. If r doesn't hold a valid URL, it writes the error
+// response and returns false.
+func (p *Proxy) upstreamFromPath(w http.ResponseWriter, r *http.Request) (*url.URL, http.Header, bool) {
+	// Expect the encoded URL in the first path segment after the base path.
+	// For example: /aHR0cHM6Ly9leGFtcGxlLmNvbQ==
+	// Simple clients may instead pass the URL unencoded in the url query
+	// parameter: /?url=https://example.com
+	encodedURL, ok := strings.CutPrefix(r.URL.Path, p.BasePath)
+	if !ok {
+		http.NotFound(w, r)
+		return nil, nil, false
+	}
+	query := removeQueryParam(r.URL.RawQuery, p.BrowseParam)
+	var upstreamURL, extraPath string
+	if target := r.URL.Query().Get(urlParam); encodedURL == "" && target != "" {
+		if len(target) > p.MaxURLLength {
+			p.httpError(w, "", "URL is too long", http.StatusRequestURITooLong)
+			return nil, nil, false
+		}
+		upstreamURL = target
+		query = removeQueryParam(query, urlParam)
+	} else {
+		if encodedURL == "" {
+			p.httpError(w, "", "Missing encoded URL", http.StatusBadRequest)
+			return nil, nil, false
+		}
+		if len(encodedURL) > p.MaxURLLength {
+			p.httpError(w, "", "Encoded URL is too long", http.StatusRequestURITooLong)
+			return nil, nil, false
+		}
+
+		// Decode the base64-encoded URL and any path that follows it.
+		var err error
+		upstreamURL, extraPath, err = decodeUpstreamPath(encodedURL, p.DefaultScheme)
+		if err != nil {
+			p.httpError(w, "", "Invalid base64 encoding: "+err.Error(), http.StatusBadRequest)
+			return nil, nil, false
+		}
+	}
+
+	// Validate the upstream URL.
+	upstreamURL = withDefaultScheme(upstreamURL, p.DefaultScheme)
+	parsedURL, err := url.Parse(upstreamURL)
+	if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
+		p.httpError(w, upstreamURL, "Invalid upstream URL", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if extraPath != "" {
+		parsedURL = parsedURL.JoinPath(extraPath)
+	}
+
+	// Query parameters on the proxy URL other than the browse flag, such as
+	// the fields of a submitted GET form, belong to the upstream, except
+	// for header parameters when they are enabled.
+	var injectedHeaders http.Header
+	if p.EnableHeaderInjection {
+		query, injectedHeaders = cutHeaderParams(query)
+	}
+	if query != "" {
+		if parsedURL.RawQuery != "" {
+			parsedURL.RawQuery += "&"
+		}
+		parsedURL.RawQuery += query
+	}
+	return parsedURL, injectedHeaders, true
+}
+
+// urlParam is the query parameter that can carry the upstream URL
+// unencoded, in place of the encoded path.
+const urlParam = "url"
+
+// upstreamEncodings are the base64 variants accepted for the encoded URL, in
+// the order they are tried.
+var upstreamEncodings = []*base64.Encoding{
+	base64.URLEncoding,
+	base64.StdEncoding,
+	base64.RawURLEncoding,
+	base64.RawStdEncoding,
+}
+
+// decodeUpstreamPath splits the path after the base path into the encoded
+// upstream URL and any path following it, as in /ENCODED/subpage, and
+// decodes the URL. The encoded URL normally ends at the first "/", so the
+// shortest prefix that decodes to an absolute URL is taken. The standard
+// base64 alphabet contains "/" too, so a longer prefix in that alphabet,
+// padding included, is preferred when there is one. Without padding such a
+// URL can't be told apart from a shorter one followed by a path.
+func decodeUpstreamPath(path, defaultScheme string) (upstream, extraPath string, err error) {
+	for end := len(path); end > 0; end = strings.LastIndexByte(path[:end], '/') {
+		if !strings.Contains(path[:end], "/") {
+			break
+		}
+		decoded, decodeErr := base64.StdEncoding.DecodeString(path[:end])
+		if decodeErr == nil && isUpstreamURL(string(decoded), defaultScheme) {
+			return string(decoded), path[end:], nil
+		}
+	}
+	for end := 0; end < len(path); {
+		if next := strings.IndexByte(path[end+1:], '/'); next >= 0 {
+			end += 1 + next
+		} else {
+			end = len(path)
+		}
+		decoded, decodeErr := decodeUpstreamURL(path[:end])
+		if decodeErr == nil && isUpstreamURL(decoded, defaultScheme) {
+			return decoded, path[end:], nil
+		}
+		if err == nil {
+			err = decodeErr
+		}
+	}
+	if err == nil {
+		err = errors.New("decoded URL is not an absolute URL")
+	}
+	return "", "", err
+}
+
+// isUpstreamURL reports whether decoded, with defaultScheme applied, is
+// valid UTF-8 and an absolute URL with a scheme and host.
+func isUpstreamURL(decoded, defaultScheme string) bool {
+	if !utf8.ValidString(decoded) {
+		return false
+	}
+	u, err := url.Parse(withDefaultScheme(decoded, defaultScheme))
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// withDefaultScheme prepends scheme to upstream if it is set and upstream
+// has none, as in "example.com/page" or "//example.com/page".
+func withDefaultScheme(upstream, scheme string) string {
+	if scheme != "" && !strings.Contains(upstream, "://") {
+		return scheme + "://" + strings.TrimPrefix(upstream, "//")
+	}
+	return upstream
+}
+
+// decodeUpstreamURL decodes the base64-encoded upstream URL. Both the
+// URL-safe and standard alphabets are accepted, with or without padding.
+func decodeUpstreamURL(encoded string) (string, error) {
+	var firstErr error
+	for _, enc := range upstreamEncodings {
+		decoded, err := enc.DecodeString(encoded)
+		if err == nil {
+			return string(decoded), nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", firstErr
+}
+
+// contentTypeBlocked reports whether the media type of contentType is one
+// of blocked, or has a "type/*" entry among them.
+func contentTypeBlocked(contentType string, blocked []string) bool {
+	if len(blocked) == 0 {
+		return false
+	}
+	media := mediaType(contentType)
+	major, _, _ := strings.Cut(media, "/")
+	for _, entry := range blocked {
+		entry = mediaType(entry)
+		if entry == media || entry == major+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffLen is how much of a body http.DetectContentType looks at.
+const sniffLen = 512
+
+// sniffContentType sets the Content-Type of resp from its first bytes if it
+// is missing or generic. The peeked bytes stay at the front of resp.Body.
+// Compressed bodies are left alone, since their bytes say nothing about
+// what they decode to.
+func sniffContentType(resp *http.Response) {
+	switch mediaType(resp.Header.Get("Content-Type")) {
+	case "", "application/octet-stream", "binary/octet-stream", "application/unknown":
+	default:
+		return
+	}
+	if encoding := strings.TrimSpace(resp.Header.Get("Content-Encoding")); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return
+	}
+	br := bufio.NewReaderSize(resp.Body, sniffLen)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+	prefix, _ := br.Peek(sniffLen)
+	if len(prefix) == 0 {
+		return
+	}
+	// Only the media type is kept: the charset DetectContentType guesses
+	// would override the page's own <meta charset>.
+	if detected := mediaType(http.DetectContentType(prefix)); detected != "application/octet-stream" {
+		resp.Header.Set("Content-Type", detected)
+	}
+}
+
+// errBodyTooLarge is returned by readBody when the body exceeds its limit.
+var errBodyTooLarge = errors.New("upstream body too large to rewrite")
+
+// readBody reads the whole upstream body for rewriting, undoing any gzip,
+// deflate or Brotli Content-Encoding. The Content-Encoding header is removed
+// from resp since the rewritten body is sent uncompressed.
+//
+// Bodies longer than limit bytes are not read in full: readBody returns
+// errBodyTooLarge and a reader that yields the whole decoded body, so it can
+// be streamed unrewritten instead.
+func readBody(resp *http.Response, limit int64) ([]byte, io.Reader, error) {
+	var body io.Reader = resp.Body
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = gz
+	case "deflate":
+		// "deflate" is meant to be zlib-wrapped, but some servers send raw
+		// deflate data, so sniff the zlib header before choosing a reader.
+		br := bufio.NewReader(resp.Body)
+		header, _ := br.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, nil, err
+			}
+			body = zr
+		} else {
+			body = flate.NewReader(br)
+		}
+	case "br":
+		body = brotli.NewReader(resp.Body)
+	default:
+		return nil, nil, fmt.Errorf("unsupported Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	resp.Header.Del("Content-Encoding")
+
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, io.MultiReader(bytes.NewReader(data), body), errBodyTooLarge
+	}
+	return data, nil, nil
+}
+
+// copyBody copies body to w until EOF, stopping early with ctx's error once
+// ctx is done. With the request's context, a client that disconnects stops
+// the copy even while the upstream is still sending; the upstream request,
+// which shares the context, is canceled along with it. If flush is not nil,
+// it is called after every write.
+func copyBody(ctx context.Context, w io.Writer, body io.Reader, flush func() error) error {
+	buf := make([]byte, 32<<10)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flush != nil {
+				if ferr := flush(); ferr != nil {
+					return ferr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// removeQueryParam returns rawQuery without the parameters called name,
+// keeping the others in their original order and encoding.
+func removeQueryParam(rawQuery, name string) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if key, err := url.QueryUnescape(key); param == "" || err == nil && key == name {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
+
+// isRedirect reports whether code is a redirect status that carries a Location header.
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,1495 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// encode returns the path segment that proxies target.
+func encode(target string) string {
+	return base64.URLEncoding.EncodeToString([]byte(target))
+}
+
+// newTestProxy returns a Proxy that may reach httptest servers and logs
+// nowhere, with opts otherwise as given.
+func newTestProxy(opts Options) *Proxy {
+	opts.AllowPrivate = true
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	return NewProxy(opts)
+}
+
+// newUpstream starts an httptest server with handler, closed when t ends.
+func newUpstream(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serve serves req with p and returns the recorded response.
+func serve(p *Proxy, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec
+}
+
+// get serves a GET for target, with query appended to the proxy URL, and
+// returns the recorded response.
+func get(p *Proxy, target, query string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+encode(target)+query, nil))
+	return rec
+}
+
+func TestRedirectLocation(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", r.URL.Query().Get("to"))
+		w.WriteHeader(http.StatusFound)
+	})
+	p := newTestProxy(Options{})
+
+	tests := []struct {
+		name, to, query, want string
+	}{
+		{"relative", "/login", "?browse=1", "http://example.com/" + encode(upstream.URL+"/login") + "?browse=1"},
+		{"absolute", "https://other.example/x", "?browse=1", "http://example.com/" + encode("https://other.example/x") + "?browse=1"},
+		{"not browsing", "/login", "", "/login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(p, upstream.URL+"/?to="+tt.to, tt.query)
+			if rec.Code != http.StatusFound {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusFound)
+			}
+			if got := rec.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressedHTMLIsRewritten(t *testing.T) {
+	const page = `<a href="/next">next</a>`
+	compress := func(newWriter func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		zw := newWriter(&buf)
+		io.WriteString(zw, page)
+		zw.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })},
+		{"deflate", compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })},
+		{"deflate", compress(func(w io.Writer) io.WriteCloser { zw, _ := flate.NewWriter(w, flate.DefaultCompression); return zw })},
+		{"br", compress(func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.Write(tt.body)
+			})
+			rec := get(newTestProxy(Options{}), upstream.URL, "?browse=1")
+			if got := rec.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+			want := `<a href="http://example.com/` + encode(upstream.URL+"/next") + `?browse=1">next</a>`
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), want)
+			}
+		})
+	}
+}
+
+func TestCompressedBodyStreamsUnchanged(t *testing.T) {
+	tests := []struct {
+		encoding  string
+		newWriter func(io.Writer) io.WriteCloser
+	}{
+		{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{"br", func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			var buf bytes.Buffer
+			zw := tt.newWriter(&buf)
+			io.WriteString(zw, "<p>hi</p>")
+			zw.Close()
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.Write(buf.Bytes())
+			})
+			// The client's Accept-Encoding is forwarded, so the transport
+			// leaves the body compressed.
+			req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL), nil)
+			req.Header.Set("Accept-Encoding", tt.encoding)
+			rec := serve(newTestProxy(Options{}), req)
+			if rec.Header().Get("Content-Encoding") != tt.encoding || !bytes.Equal(rec.Body.Bytes(), buf.Bytes()) {
+				t.Errorf("got Content-Encoding %q and %d bytes, want the %s body unchanged", rec.Header().Get("Content-Encoding"), rec.Body.Len(), tt.encoding)
+			}
+		})
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	rec := get(newTestProxy(Options{UpstreamTimeout: 50 * time.Millisecond}), upstream.URL, "")
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+	tests := []struct {
+		name       string
+		global     time.Duration
+		timeouts   map[string]time.Duration
+		wantStatus int
+	}{
+		{"longer for the host", 50 * time.Millisecond, map[string]time.Duration{"127.0.0.1": 2 * time.Second}, http.StatusOK},
+		{"other host", 50 * time.Millisecond, map[string]time.Duration{"slow.test": 2 * time.Second}, http.StatusGatewayTimeout},
+		{"shorter for the host", 2 * time.Second, map[string]time.Duration{"127.0.0.1": 50 * time.Millisecond}, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(Options{UpstreamTimeout: tt.global, UpstreamTimeouts: tt.timeouts})
+			if rec := get(p, upstream.URL, ""); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestTLSOrigin(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<a href="/next">next</a>`)
+	})
+	srv := httptest.NewUnstartedServer(newTestProxy(Options{}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/" + encode(upstream.URL) + "?browse=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 {
+		t.Errorf("protocol = %s, want HTTP/2", resp.Proto)
+	}
+	want := `href="` + srv.URL + "/" + encode(upstream.URL+"/next") + `?browse=1"`
+	if !strings.HasPrefix(srv.URL, "https://") || !strings.Contains(string(body), want) {
+		t.Errorf("body = %q, want it to contain %q", body, want)
+	}
+}
+
+func TestMaxRewriteBytes(t *testing.T) {
+	const page = `<a href="/next">next</a>`
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, page)
+	})
+	rewritten := `<a href="http://example.com/` + encode(upstream.URL+"/next") + `?browse=1">next</a>`
+	tests := []struct {
+		name  string
+		limit int64
+		want  string
+	}{
+		{"under the limit", int64(len(page)), rewritten},
+		{"over the limit", int64(len(page)) - 1, page},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(newTestProxy(Options{MaxRewriteBytes: tt.limit}), upstream.URL, "?browse=1")
+			if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("got %d %q, want 200 with %q", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeUpstreamURL(t *testing.T) {
+	// This URL encodes to characters that differ between the alphabets,
+	// and to padding.
+	const target = "https://example.com/?q=>>?~x"
+	tests := []struct {
+		name string
+		enc  *base64.Encoding
+	}{
+		{"URL", base64.URLEncoding},
+		{"standard", base64.StdEncoding},
+		{"raw URL", base64.RawURLEncoding},
+		{"raw standard", base64.RawStdEncoding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := tt.enc.EncodeToString([]byte(target))
+			got, err := decodeUpstreamURL(encoded)
+			if err != nil || got != target {
+				t.Errorf("decodeUpstreamURL(%q) = %q, %v; want %q", encoded, got, err, target)
+			}
+		})
+	}
+	if _, err := decodeUpstreamURL("not base64!"); err == nil {
+		t.Error("decodeUpstreamURL accepted invalid input")
+	}
+}
+
+func TestDecodeUpstreamPath(t *testing.T) {
+	tests := []struct {
+		name, target, extra string
+		enc                 *base64.Encoding
+	}{
+		{"URL", "https://example.com/app", "/sub", base64.URLEncoding},
+		// Each of these also decodes whole as unpadded standard base64.
+		{"raw URL, root", "https://example.com/", "/ab", base64.RawURLEncoding},
+		{"raw URL, path", "https://example.com/ab", "/api/v1", base64.RawURLEncoding},
+		{"standard with slash", "https://example.com/?q=>>?~x", "", base64.StdEncoding},
+		{"standard with slash and path", "https://example.com/?q=>>?~x", "/sub", base64.StdEncoding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.enc.EncodeToString([]byte(tt.target)) + tt.extra
+			upstream, extra, err := decodeUpstreamPath(path, "")
+			if err != nil || upstream != tt.target || extra != tt.extra {
+				t.Errorf("decodeUpstreamPath(%q) = %q, %q, %v; want %q, %q", path, upstream, extra, err, tt.target, tt.extra)
+			}
+		})
+	}
+	if _, _, err := decodeUpstreamPath(base64.URLEncoding.EncodeToString([]byte("not a URL")), ""); err == nil {
+		t.Error("decodeUpstreamPath accepted a relative URL")
+	}
+}
+
+func TestBrowseParam(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<a href="/next">next</a>`)
+	})
+	p := newTestProxy(Options{BrowseParam: "via"})
+	tests := []struct {
+		query, want string
+	}{
+		{"?via=1", `href="http://example.com/` + encode(upstream.URL+"/next") + `?via=1"`},
+		{"?browse=1", `href="/next"`},
+	}
+	for _, tt := range tests {
+		rec := get(p, upstream.URL, tt.query)
+		if !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: body = %q, want it to contain %q", tt.query, rec.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestRewriteJSONOptIn(t *testing.T) {
+	const body = `{"url":"https://cdn.example.com/a.png"}`
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	})
+	tests := []struct {
+		enabled bool
+		want    string
+	}{
+		{false, body},
+		{true, `{"url":"http://example.com/` + encode("https://cdn.example.com/a.png") + `?browse=1"}`},
+	}
+	for _, tt := range tests {
+		rec := get(newTestProxy(Options{RewriteJSON: tt.enabled}), upstream.URL, "?browse=1")
+		if rec.Body.String() != tt.want {
+			t.Errorf("RewriteJSON=%v: body = %q, want %q", tt.enabled, rec.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestBinaryBodyStreamedInBrowseMode(t *testing.T) {
+	body := bytes.Repeat([]byte("\x89PNG url(/x) <a href=/y>"), 1000)
+	tests := []string{"image/png", "video/mp4", "application/octet-stream"}
+	for _, contentType := range tests {
+		t.Run(contentType, func(t *testing.T) {
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.Write(body)
+			})
+			rec := get(newTestProxy(Options{}), upstream.URL, "?browse=1")
+			if !bytes.Equal(rec.Body.Bytes(), body) {
+				t.Errorf("got %d bytes, want the %d byte body unchanged", rec.Body.Len(), len(body))
+			}
+			if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(body)) {
+				t.Errorf("Content-Length = %q, want %d", got, len(body))
+			}
+		})
+	}
+}
+
+// BenchmarkBinaryBody compares streaming a large body, as the proxy does
+// for bodies it doesn't rewrite, with buffering it whole, as it does for
+// those it rewrites.
+func BenchmarkBinaryBody(b *testing.B) {
+	body := bytes.Repeat([]byte{0x00, 0x7f, 0x80, 0xff}, 4<<20)
+	// Hide io.ReaderFrom and io.WriterTo, which would let the copies skip
+	// the code under test.
+	dst := struct{ io.Writer }{io.Discard}
+	newBody := func() io.Reader { return struct{ io.Reader }{bytes.NewReader(body)} }
+
+	b.Run("streamed", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := copyBody(context.Background(), dst, newBody(), nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("buffered", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(newBody())}
+			data, _, err := readBody(resp, int64(len(body)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			dst.Write(data)
+		}
+	})
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/truncated":
+			w.Header().Set("Content-Length", "100")
+			io.WriteString(w, "<p>short")
+		case "/bad-gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			io.WriteString(w, "not gzip")
+		}
+	})
+	tests := []struct {
+		name, method, target string
+		want                 int
+	}{
+		{"unreachable upstream", http.MethodGet, closed.URL, http.StatusBadGateway},
+		{"truncated body", http.MethodGet, upstream.URL + "/truncated", http.StatusBadGateway},
+		{"undecodable body", http.MethodGet, upstream.URL + "/bad-gzip", http.StatusBadGateway},
+		{"invalid request", "BAD METHOD", upstream.URL, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+encode(tt.target)+"?browse=1", nil)
+			req.Method = tt.method
+			if rec := serve(newTestProxy(Options{}), req); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (%q)", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<a href="/next">next</a>`)
+	})
+	for _, basePath := range []string{"/proxy/", "/proxy", "proxy"} {
+		t.Run(basePath, func(t *testing.T) {
+			p := newTestProxy(Options{BasePath: basePath})
+			rec := serve(p, httptest.NewRequest(http.MethodGet, "/proxy/"+encode(upstream.URL)+"?browse=1", nil))
+			want := `href="http://example.com/proxy/` + encode(upstream.URL+"/next") + `?browse=1"`
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), want)
+			}
+			if rec := serve(p, httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL), nil)); rec.Code != http.StatusNotFound {
+				t.Errorf("request outside the base path: status = %d, want %d", rec.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestNewProxyDefaults(t *testing.T) {
+	p := NewProxy(Options{})
+	tests := []struct {
+		name      string
+		got, want any
+	}{
+		{"BasePath", p.BasePath, "/"},
+		{"BrowseParam", p.BrowseParam, "browse"},
+		{"MaxURLLength", p.MaxURLLength, 8 << 10},
+		{"MaxRewriteBytes", p.MaxRewriteBytes, int64(10 << 20)},
+		{"BlockStatus", p.BlockStatus, http.StatusForbidden},
+		{"UpstreamTimeout", p.UpstreamTimeout, 30 * time.Second},
+		{"Logger", p.Logger != nil, true},
+		{"Client", p.Client != nil, true},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestEmbeddedProxy(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "app") })
+	mux.Handle("/fetch/", newTestProxy(Options{BasePath: "/fetch/"}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for path, want := range map[string]string{"/app": "app", "/fetch/" + encode(upstream.URL): "upstream"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("GET %s = %q, want %q", path, body, want)
+		}
+	}
+}
+
+// recordingLogger is a Logger that keeps its messages.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	logger := &recordingLogger{}
+	get(newTestProxy(Options{Logger: logger}), upstream.URL, "")
+
+	tests := []string{
+		"Incoming request: GET /" + encode(upstream.URL),
+		"proxying to " + upstream.URL,
+		"Upstream response: 202 for " + upstream.URL,
+	}
+	all := strings.Join(logger.messages, "\n")
+	for _, want := range tests {
+		if !strings.Contains(all, want) {
+			t.Errorf("log %q does not contain %q", all, want)
+		}
+	}
+	// Messages carry the request ID.
+	for _, msg := range logger.messages {
+		if !strings.HasPrefix(msg, "[") {
+			t.Errorf("message %q has no request ID prefix", msg)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", "1234")
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.Header().Set("X-Upstream", "1")
+		if r.URL.Path == "/moved" {
+			w.Header().Set("Location", "/new")
+			w.WriteHeader(http.StatusMovedPermanently)
+		}
+	})
+	tests := []struct {
+		name, path string
+		status     int
+		header     map[string]string
+	}{
+		{"page", "/", http.StatusOK, map[string]string{
+			"X-Upstream": "1",
+			"Link":       "<http://example.com/" + encode(upstream.URL+"/style.css") + "?browse=1>; rel=preload",
+		}},
+		{"redirect", "/moved", http.StatusMovedPermanently, map[string]string{
+			"Location": "http://example.com/" + encode(upstream.URL+"/new") + "?browse=1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodHead, "/"+encode(upstream.URL+tt.path)+"?browse=1", nil)
+			rec := serve(newTestProxy(Options{}), req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if rec.Body.Len() != 0 {
+				t.Errorf("body = %q, want none", rec.Body.String())
+			}
+			for name, want := range tt.header {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFollowRedirectsBase(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/sub/new", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<a href="x">x</a>`)
+	})
+	tests := []struct {
+		name   string
+		follow bool
+		status int
+		want   string
+	}{
+		{"followed", true, http.StatusOK, `href="http://example.com/` + encode(upstream.URL+"/sub/x") + `?browse=1"`},
+		{"not followed", false, http.StatusFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(newTestProxy(Options{FollowRedirects: tt.follow}), upstream.URL+"/old", "?browse=1")
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("got %d %q, want %d with %q", rec.Code, rec.Body.String(), tt.status, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientCancelStopsUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers bool // whether the upstream has sent its headers before the client goes away
+	}{
+		{"waiting for headers", false},
+		{"streaming body", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, canceled := make(chan struct{}), make(chan struct{})
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.headers {
+					w.Header().Set("Content-Type", "application/octet-stream")
+					w.Write([]byte("partial"))
+					w.(http.Flusher).Flush()
+				}
+				close(started)
+				select {
+				case <-r.Context().Done():
+					close(canceled)
+				case <-time.After(5 * time.Second):
+				}
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL), nil).WithContext(ctx)
+			done := make(chan struct{})
+			go func() {
+				serve(newTestProxy(Options{}), req)
+				close(done)
+			}()
+			<-started
+			cancel()
+			select {
+			case <-canceled:
+			case <-time.After(2 * time.Second):
+				t.Fatal("upstream request was not canceled")
+			}
+			<-done
+		})
+	}
+}
+
+// newTLSUpstream starts an httptest TLS server with handler, closed when t
+// ends, and returns it with a pool trusting its certificate.
+func newTLSUpstream(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return srv, pool
+}
+
+func TestDefaultScheme(t *testing.T) {
+	upstream, pool := newTLSUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			t.Error("upstream request was not made over TLS")
+		}
+		io.WriteString(w, r.URL.Path)
+	})
+	hostPath := strings.TrimPrefix(upstream.URL, "https://") + "/path"
+	tests := []struct {
+		name, scheme, target string
+		status               int
+	}{
+		{"strict", "", hostPath, http.StatusBadRequest},
+		{"https", "https", hostPath, http.StatusOK},
+		{"protocol-relative", "https", "//" + hostPath, http.StatusOK},
+		{"scheme given", "http", upstream.URL + "/path", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(newTestProxy(Options{DefaultScheme: tt.scheme, UpstreamCAs: pool}), tt.target, "")
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (%q)", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != "/path" {
+				t.Errorf("body = %q, want %q", rec.Body.String(), "/path")
+			}
+		})
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("name", "report")
+	fw, _ := mw.CreateFormFile("file", "data.bin")
+	fw.Write([]byte{0, 1, 2, 0xff})
+	mw.Close()
+
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != mw.FormDataContentType() {
+			t.Errorf("Content-Type = %q, want %q", got, mw.FormDataContentType())
+		}
+		if r.ContentLength != int64(body.Len()) {
+			t.Errorf("Content-Length = %d, want %d", r.ContentLength, body.Len())
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		if r.FormValue("name") != "report" || !bytes.Equal(data, []byte{0, 1, 2, 0xff}) {
+			t.Errorf("got name %q and file %v", r.FormValue("name"), data)
+		}
+	})
+	for _, query := range []string{"", "?browse=1"} {
+		req := httptest.NewRequest(http.MethodPost, "/"+encode(upstream.URL)+query, bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if rec := serve(newTestProxy(Options{}), req); rec.Code != http.StatusOK {
+			t.Errorf("%q: status = %d, want %d", query, rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	const limit = 2
+	started, release := make(chan struct{}), make(chan struct{})
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	})
+	p := newTestProxy(Options{MaxConcurrent: limit})
+
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := get(p, upstream.URL+"/slow", ""); rec.Code != http.StatusOK {
+				t.Errorf("slow request: status = %d, want %d", rec.Code, http.StatusOK)
+			}
+		}()
+		<-started
+	}
+	rec := get(p, upstream.URL, "")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("request over the limit: got %d with Retry-After %q, want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	close(release)
+	wg.Wait()
+
+	// Slots are released on every path, errors included.
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{upstream.URL, http.StatusOK},
+		{"ftp://example.com/", http.StatusBadGateway},
+		{"ftp://example.com/", http.StatusBadGateway},
+		{"ftp://example.com/", http.StatusBadGateway},
+		{upstream.URL, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := get(p, tt.target, ""); rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.target, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestQueryMergedIntoUpstream(t *testing.T) {
+	var got string
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RawQuery
+	})
+	tests := []struct {
+		name, target, query, want string
+	}{
+		{"GET form", upstream.URL + "/search", "?browse=1&q=hello+world&page=2", "q=hello+world&page=2"},
+		{"existing query", upstream.URL + "/search?lang=en", "?q=x&browse=1", "lang=en&q=x"},
+		{"browse only", upstream.URL + "/search?lang=en", "?browse=1", "lang=en"},
+		{"none", upstream.URL + "/search", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get(newTestProxy(Options{}), tt.target, tt.query)
+			if got != tt.want {
+				t.Errorf("upstream query = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSVerification(t *testing.T) {
+	upstream, pool := newTLSUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name string
+		opts Options
+		want int
+	}{
+		{"verified by default", Options{}, http.StatusBadGateway},
+		{"insecure", Options{InsecureUpstream: true}, http.StatusOK},
+		{"custom CA", Options{UpstreamCAs: pool}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := get(newTestProxy(tt.opts), upstream.URL, ""); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (%q)", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestTrailingPath(t *testing.T) {
+	var got string
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	})
+	tests := []struct {
+		name, target, extra, want string
+	}{
+		{"none", upstream.URL + "/app", "", "/app"},
+		{"subpage", upstream.URL + "/app", "/subpage", "/app/subpage"},
+		{"nested", upstream.URL + "/app/", "/a/b", "/app/a/b"},
+		{"with query", upstream.URL + "/app?x=1", "/sub", "/app/sub?x=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serve(newTestProxy(Options{}), httptest.NewRequest(http.MethodGet, "/"+encode(tt.target)+tt.extra, nil))
+			if got != tt.want {
+				t.Errorf("upstream got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewritersByContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		types       map[string]string
+		want        *contentRewriter
+	}{
+		{"text/html", nil, htmlRewriter},
+		{"application/xhtml+xml; charset=utf-8", nil, htmlRewriter},
+		{"Text/HTML ; charset=iso-8859-1", nil, htmlRewriter},
+		{"application/x-javascript", nil, jsRewriter},
+		{"application/ecmascript", nil, jsRewriter},
+		{"text/css", nil, cssRewriter},
+		{"application/json", nil, nil},
+		{"image/png", nil, nil},
+		{"application/vnd.example+html", map[string]string{"application/vnd.example+html": "HTML"}, htmlRewriter},
+		{"text/css", map[string]string{"text/css": ""}, nil},
+	}
+	for _, tt := range tests {
+		p := newTestProxy(Options{RewriteTypes: tt.types})
+		if got := p.rewriterFor(tt.contentType); got != tt.want {
+			t.Errorf("rewriterFor(%q) with %v = %v, want %v", tt.contentType, tt.types, got, tt.want)
+		}
+	}
+}
+
+func TestXHTMLIsRewritten(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xhtml+xml")
+		io.WriteString(w, `<html xmlns="http://www.w3.org/1999/xhtml"><body><a href="/next">next</a></body></html>`)
+	})
+	rec := get(newTestProxy(Options{}), upstream.URL, "?browse=1")
+	if want := `href="http://example.com/` + encode(upstream.URL+"/next") + `?browse=1"`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("body = %q, want it to contain %q", rec.Body.String(), want)
+	}
+}
+
+func TestRefreshHeader(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Refresh", "5; url=/next")
+	})
+	tests := []struct {
+		query, want string
+	}{
+		{"?browse=1", "5;url=http://example.com/" + encode(upstream.URL+"/next") + "?browse=1"},
+		{"", "5; url=/next"},
+	}
+	for _, tt := range tests {
+		if got := get(newTestProxy(Options{}), upstream.URL, tt.query).Header().Get("Refresh"); got != tt.want {
+			t.Errorf("%q: Refresh = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestRequestBodyLength(t *testing.T) {
+	for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		t.Run(method, func(t *testing.T) {
+			const body = "known length body"
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				if r.Method != method || r.ContentLength != int64(len(body)) || len(r.TransferEncoding) != 0 || string(data) != body {
+					t.Errorf("upstream got %s with Content-Length %d, Transfer-Encoding %v and body %q", r.Method, r.ContentLength, r.TransferEncoding, data)
+				}
+			})
+			req := httptest.NewRequest(method, "/"+encode(upstream.URL), strings.NewReader(body))
+			if rec := serve(newTestProxy(Options{}), req); rec.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	next := make(chan struct{})
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	// The stream outlives the upstream timeout.
+	px := httptest.NewServer(newTestProxy(Options{UpstreamTimeout: 100 * time.Millisecond}))
+	defer px.Close()
+
+	resp, err := http.Get(px.URL + "/" + encode(upstream.URL) + "?browse=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	for i := 1; i <= 3; i++ {
+		// Each event arrives before the upstream sends the next one.
+		line, err := br.ReadString('\n')
+		if want := fmt.Sprintf("data: %d\n", i); err != nil || line != want {
+			t.Fatalf("event %d: got %q, %v; want %q", i, line, err, want)
+		}
+		br.ReadString('\n')
+		time.Sleep(75 * time.Millisecond)
+		select {
+		case next <- struct{}{}:
+		case <-time.After(time.Second):
+			t.Fatalf("upstream stopped after event %d", i)
+		}
+	}
+}
+
+func TestUpstreamTimeoutCoversBody(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("start"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+			w.Write([]byte("end"))
+		}
+	})
+	rec := get(newTestProxy(Options{UpstreamTimeout: 100 * time.Millisecond}), upstream.URL, "")
+	if rec.Body.String() != "start" {
+		t.Errorf("body = %q, want the stream cut off after %q", rec.Body.String(), "start")
+	}
+}
+
+func TestRangePassthrough(t *testing.T) {
+	body := `<html><a href="/x">0123456789</a></html>`
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	})
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		wantStatus   int
+		wantBody     string
+		wantRange    string
+		wantRewrites bool
+	}{
+		{"range", "bytes=6-13", http.StatusPartialContent, body[6:14], "bytes 6-13/" + strconv.Itoa(len(body)), false},
+		{"open-ended range", "bytes=20-", http.StatusPartialContent, body[20:], "bytes 20-" + strconv.Itoa(len(body)-1) + "/" + strconv.Itoa(len(body)), false},
+		{"no range", "", http.StatusOK, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL)+"?browse=1", nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rec := serve(newTestProxy(Options{}), req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantRewrites {
+				if !strings.Contains(rec.Body.String(), encode(upstream.URL+"/x")) {
+					t.Errorf("body %q is not rewritten", rec.Body.String())
+				}
+				return
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.wantRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantRange)
+			}
+			if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(tt.wantBody)) {
+				t.Errorf("Content-Length = %q, want %d", got, len(tt.wantBody))
+			}
+			if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("Accept-Ranges = %q, want bytes", got)
+			}
+		})
+	}
+}
+
+func TestMaxURLLength(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"within limit", upstream.URL + "/", http.StatusOK},
+		{"over limit", upstream.URL + "/" + strings.Repeat("a", 64), http.StatusRequestURITooLong},
+	}
+	p := newTestProxy(Options{MaxURLLength: 64})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := get(p, tt.target, ""); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+	t.Run("not decoded", func(t *testing.T) {
+		rec := serve(p, httptest.NewRequest(http.MethodGet, "/"+strings.Repeat("!", 100), nil))
+		if rec.Code != http.StatusRequestURITooLong {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestURITooLong)
+		}
+	})
+}
+
+func TestNotModified(t *testing.T) {
+	const etag = `"v1"`
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(`<a href="/x">x</a>`))
+	})
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        int
+	}{
+		{"matching ETag", etag, http.StatusNotModified},
+		{"stale ETag", `"v0"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL)+"?browse=1", nil)
+			req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			rec := serve(newTestProxy(Options{}), req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %q, want %q", got, etag)
+			}
+			if tt.want == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("304 has body %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRewriteFallback(t *testing.T) {
+	const body = "original body"
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/x-broken")
+		w.Write([]byte(body))
+	})
+	failing := &contentRewriter{"broken", func([]byte, *url.URL, *rewriteOptions) ([]byte, error) {
+		return nil, errors.New("render failed")
+	}}
+	tests := []struct {
+		name       string
+		fallback   bool
+		wantStatus int
+		wantBody   string
+		wantLog    string
+	}{
+		{"fallback", true, http.StatusOK, body, "serving it unrewritten: render failed"},
+		{"no fallback", false, http.StatusInternalServerError, "Error rewriting broken: render failed\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			p := newTestProxy(Options{RewriteFallback: tt.fallback, Logger: logger})
+			p.rewriters["text/x-broken"] = failing
+			rec := get(p, upstream.URL, "?browse=1")
+			if rec.Code != tt.wantStatus || rec.Body.String() != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if all := strings.Join(logger.messages, "\n"); !strings.Contains(all, tt.wantLog) {
+				t.Errorf("log %q does not contain %q", all, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestForwardProxy(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<a href="/next">%s</a>`, r.URL.RequestURI())
+	})
+	tests := []struct {
+		name       string
+		enabled    bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"enabled", true, http.StatusOK, `<a href="/next">/page?q=1</a>`},
+		{"disabled", false, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(newTestProxy(Options{EnableForwardProxy: tt.enabled}))
+			defer server.Close()
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(mustParse(t, server.URL))}}
+			resp, err := client.Get(upstream.URL + "/page?q=1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "%d %s", len(body), r.Header.Get("Expect"))
+	})
+	server := httptest.NewServer(newTestProxy(Options{MaxRequestBody: 1024}))
+	defer server.Close()
+	tests := []struct {
+		name       string
+		size       int
+		chunked    bool
+		expect     bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"within limit", 1024, false, false, http.StatusOK, "1024 "},
+		{"100-continue", 1024, false, true, http.StatusOK, "1024 100-continue"},
+		{"declared too large", 1025, false, true, http.StatusRequestEntityTooLarge, ""},
+		{"chunked too large", 4096, true, false, http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = bytes.NewReader(bytes.Repeat([]byte("x"), tt.size))
+			if tt.chunked {
+				// Hiding the length makes the client send it chunked.
+				body = struct{ io.Reader }{body}
+			}
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/"+encode(upstream.URL), body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expect {
+				req.Header.Set("Expect", "100-continue")
+			}
+			client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			got, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBody != "" && string(got) != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"after every read", -1},
+		{"periodically", 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("first "))
+				w.(http.Flusher).Flush()
+				select {
+				case <-release:
+				case <-time.After(5 * time.Second):
+				}
+				w.Write([]byte("second"))
+			})
+			server := httptest.NewServer(newTestProxy(Options{FlushInterval: tt.interval}))
+			defer server.Close()
+			// The headers and the first write must arrive while the
+			// upstream is still holding back the rest.
+			type result struct {
+				resp  *http.Response
+				first string
+				err   error
+			}
+			results := make(chan result, 1)
+			go func() {
+				resp, err := http.Get(server.URL + "/" + encode(upstream.URL))
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				buf := make([]byte, len("first "))
+				n, err := io.ReadFull(resp.Body, buf)
+				results <- result{resp, string(buf[:n]), err}
+			}()
+			var res result
+			select {
+			case res = <-results:
+			case <-time.After(2 * time.Second):
+				close(release)
+				t.Fatal("first write was not flushed to the client")
+			}
+			close(release)
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			defer res.resp.Body.Close()
+			if res.first != "first " {
+				t.Errorf("first read = %q, want %q", res.first, "first ")
+			}
+			rest, _ := io.ReadAll(res.resp.Body)
+			if string(rest) != "second" {
+				t.Errorf("rest = %q, want %q", rest, "second")
+			}
+		})
+	}
+}
+
+func TestURLParam(t *testing.T) {
+	var got string
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	})
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{"plain", "?url=" + url.QueryEscape(upstream.URL+"/page?a=1"), http.StatusOK, "/page?a=1"},
+		{"with other params", "?url=" + url.QueryEscape(upstream.URL+"/page") + "&b=2", http.StatusOK, "/page?b=2"},
+		{"invalid", "?url=" + url.QueryEscape("not a url"), http.StatusBadRequest, ""},
+		{"empty", "?url=", http.StatusBadRequest, ""},
+	}
+	p := newTestProxy(Options{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			rec := serve(p, httptest.NewRequest(http.MethodGet, "/"+tt.query, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got != tt.want {
+				t.Errorf("upstream got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressOutput(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/next">next</a>`))
+	})
+	want := `<a href="http://example.com/` + encode(upstream.URL+"/next") + `?browse=1">next</a>`
+	tests := []struct {
+		name           string
+		compress       bool
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"gzip client", true, "gzip, deflate, br", true},
+		{"identity client", true, "identity", false},
+		{"wildcard", true, "*", true},
+		{"gzip refused", true, "gzip;q=0, *", false},
+		{"disabled", false, "gzip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL)+"?browse=1", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := serve(newTestProxy(Options{CompressOutput: tt.compress}), req)
+			body := rec.Body.String()
+			if tt.wantGzip {
+				if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+					t.Fatalf("Content-Encoding = %q, want gzip", got)
+				}
+				if got := rec.Header().Get("Vary"); !strings.Contains(got, "Accept-Encoding") {
+					t.Errorf("Vary = %q, want it to contain Accept-Encoding", got)
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(data)
+			} else if got := rec.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+			if !strings.Contains(body, want) {
+				t.Errorf("body = %q, want it to contain %q", body, want)
+			}
+		})
+	}
+}
+
+func TestSniffContent(t *testing.T) {
+	const page = `<html><body><a href="/next">next</a></body></html>`
+	tests := []struct {
+		name        string
+		contentType []string
+		sniff       bool
+		wantRewrite bool
+	}{
+		{"untyped", nil, true, true},
+		{"octet-stream", []string{"application/octet-stream"}, true, true},
+		{"disabled", []string{"application/octet-stream"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				// A nil value keeps net/http from sniffing the type itself.
+				w.Header()["Content-Type"] = tt.contentType
+				w.Write([]byte(page))
+			})
+			req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL)+"?browse=1", nil)
+			rec := serve(newTestProxy(Options{SniffContent: tt.sniff}), req)
+			want := `href="/next"`
+			if tt.wantRewrite {
+				want = `href="http://example.com/` + encode(upstream.URL+"/next") + `?browse=1"`
+			}
+			if body := rec.Body.String(); !strings.Contains(body, want) {
+				t.Errorf("body = %q, want it to contain %q", body, want)
+			}
+		})
+	}
+}
+
+func TestBlockContentType(t *testing.T) {
+	const payload = "binary payload"
+	tests := []struct {
+		name        string
+		contentType string
+		blocked     []string
+		status      int
+		wantStatus  int
+	}{
+		{"exact", "application/x-msdownload", []string{"application/x-msdownload"}, 0, http.StatusForbidden},
+		{"wildcard", "video/mp4", []string{"video/*"}, http.StatusUnsupportedMediaType, http.StatusUnsupportedMediaType},
+		{"with parameters", "audio/mpeg; codecs=mp3", []string{"audio/mpeg"}, 0, http.StatusForbidden},
+		{"allowed", "text/plain", []string{"video/*"}, 0, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(payload))
+			})
+			p := newTestProxy(Options{BlockContentTypes: tt.blocked, BlockStatus: tt.status})
+			rec := serve(p, httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL), nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if streamed := strings.Contains(rec.Body.String(), payload); streamed != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("body = %q, streamed = %v", rec.Body.String(), streamed)
+			}
+		})
+	}
+}
+
+func TestBufferedBodyRedirect(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			http.Redirect(w, r, "/end", http.StatusTemporaryRedirect)
+			return
+		}
+		io.Copy(w, r.Body)
+	})
+	tests := []struct {
+		name       string
+		maxBuffer  int64
+		wantStatus int
+		wantBody   string
+	}{
+		{"buffered", 1024, http.StatusOK, "data"},
+		// The Client can't resend a streamed body, so the redirect is
+		// passed to the client instead.
+		{"larger than the buffer", 2, http.StatusTemporaryRedirect, ""},
+		{"not buffered", 0, http.StatusTemporaryRedirect, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(Options{FollowRedirects: true, MaxBufferBody: tt.maxBuffer})
+			rec := serve(p, httptest.NewRequest(http.MethodPost, "/"+encode(upstream.URL+"/start"), strings.NewReader("data")))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<a href="/next">next</a>`)
+		w.Header().Set("X-Checksum", "abc123")
+	})
+	px := httptest.NewServer(newTestProxy(Options{}))
+	defer px.Close()
+	for _, query := range []string{"", "?browse=1"} {
+		t.Run("query "+query, func(t *testing.T) {
+			resp, err := http.Get(px.URL + "/" + encode(upstream.URL) + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if _, err := io.ReadAll(resp.Body); err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+				t.Errorf("X-Checksum trailer = %q, want %q", got, "abc123")
+			}
+		})
+	}
+}
+
+// failingWriter is a ResponseWriter whose body writes fail.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestCompressOutputWriteError(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/next">next</a>`))
+	})
+	logger := &recordingLogger{}
+	p := newTestProxy(Options{CompressOutput: true, Logger: logger})
+	req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL)+"?browse=1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	p.ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+	if all := strings.Join(logger.messages, "\n"); !strings.Contains(all, "connection reset") {
+		t.Errorf("log %q does not mention the write error", all)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader carries the ID that ties the log lines of a request to
+// its upstream request and its response.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds the length of an incoming request ID that is used
+// as is.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// withRequestID wraps h so that every request has an ID: the client's
+// X-Request-ID if it sent a usable one, or a new random one. The ID is sent
+// upstream, since headers are copied from r, and returned in the response.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			var b [16]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether id is non-empty, not too long, and made
+// of printable ASCII, so it can be logged and echoed safely.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID of the request that ctx belongs to, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logger returns the Logger for the request that ctx belongs to, which
+// prefixes every message with the request ID.
+func (p *Proxy) logger(ctx context.Context) Logger {
+	if id := requestID(ctx); id != "" {
+		return prefixLogger{p.Logger, "[" + id + "] "}
+	}
+	return p.Logger
+}
+
+// prefixLogger is a Logger that puts prefix before every message.
+type prefixLogger struct {
+	Logger
+	prefix string
+}
+
+func (l prefixLogger) Printf(format string, v ...any) {
+	l.Logger.Printf(l.prefix+format, v...)
+}
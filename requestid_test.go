@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var upstreamID string
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(requestIDHeader)
+	})
+	tests := []struct {
+		name     string
+		incoming string
+		want     string // "" for a generated ID
+	}{
+		{"generated", "", ""},
+		{"honored", "trace-123", "trace-123"},
+		{"too long", strings.Repeat("a", maxRequestIDLen+1), ""},
+		{"unprintable", "bad id", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			req := httptest.NewRequest(http.MethodGet, "/"+encode(upstream.URL), nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			rec := serve(newTestProxy(Options{Logger: logger}), req)
+
+			id := rec.Header().Get(requestIDHeader)
+			if tt.want != "" && id != tt.want {
+				t.Errorf("response ID = %q, want %q", id, tt.want)
+			}
+			if tt.want == "" && (len(id) != 32 || id == tt.incoming) {
+				t.Errorf("response ID = %q, want a new 32 digit ID", id)
+			}
+			if upstreamID != id {
+				t.Errorf("upstream ID = %q, want %q", upstreamID, id)
+			}
+			if len(logger.messages) == 0 {
+				t.Fatal("nothing was logged")
+			}
+			for _, msg := range logger.messages {
+				if !strings.HasPrefix(msg, "["+id+"] ") {
+					t.Errorf("log line %q does not start with the ID", msg)
+				}
+			}
+		})
+	}
+}
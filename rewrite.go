@@ -1,31 +1,294 @@
-package main
+package proxy
 
 import (
 	"bytes"
 	"encoding/base64"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/url"
 	"regexp"
 	"strings"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
+// rewriteOptions describes the proxy URLs the rewriters produce.
+type rewriteOptions struct {
+	// origin is the scheme and host the client used to reach the proxy.
+	origin string
+	// basePath is the path the proxy is mounted at. It starts and ends with "/".
+	basePath string
+	// browseParam is the query parameter that turns on browse mode.
+	browseParam string
+	// logger receives errors that don't stop the rewrite.
+	logger Logger
+	// rewriteAJAX enables the heuristic rewriting of URLs passed to AJAX
+	// helpers in JavaScript.
+	rewriteAJAX bool
+	// sameOriginOnly limits rewriting in HTML, attributes and inline CSS
+	// and JavaScript alike, to URLs on the page's own host.
+	sameOriginOnly bool
+	// pageHost is that host. rewriteHTML sets it when sameOriginOnly is
+	// set, and URLs on other hosts are then left to load directly.
+	pageHost string
+	// extraAttrs holds the URL attributes rewritten in HTML beyond the
+	// standard ones, by lowercase element name.
+	extraAttrs map[string]map[string]bool
+}
+
+// proxyURL returns the proxy URL that serves target in browse mode,
+// i.e. origin + basePath + base64(target) + "?" + browseParam + "=1". The query of
+// target is part of the encoded URL. Its fragment is never sent upstream but
+// may drive in-page navigation or hash routing, so it is moved after the
+// browse parameter where the browser still sees it. A target that already
+// points into the proxy, such as a page linking to itself through it, is
+// returned as is rather than encoded a second time.
+func (o *rewriteOptions) proxyURL(target *url.URL) string {
+	if o.isProxyURL(target) || o.loadsDirectly(target) {
+		return target.String()
+	}
+	withoutFragment := *target
+	withoutFragment.Fragment, withoutFragment.RawFragment = "", ""
+	encoded := base64.URLEncoding.EncodeToString([]byte(withoutFragment.String()))
+	proxied := o.origin + o.basePath + encoded + "?" + url.QueryEscape(o.browseParam) + "=1"
+	if target.Fragment != "" {
+		proxied += "#" + target.EscapedFragment()
+	}
+	return proxied
+}
+
+// webSocketURL returns the proxy URL that tunnels a WebSocket connection to
+// target, an absolute ws or wss URL. Its scheme is ws or wss to match origin.
+// A target that already points into the proxy is returned as is, and ok is
+// false for a target with any other scheme.
+func (o *rewriteOptions) webSocketURL(target *url.URL) (proxied string, ok bool) {
+	httpTarget := *target
+	switch target.Scheme {
+	case "ws":
+		httpTarget.Scheme = "http"
+	case "wss":
+		httpTarget.Scheme = "https"
+	default:
+		return "", false
+	}
+	if o.isProxyURL(&httpTarget) || o.loadsDirectly(target) {
+		return target.String(), true
+	}
+	scheme, host, _ := strings.Cut(o.origin, "://")
+	if scheme == "https" {
+		scheme = "wss"
+	} else {
+		scheme = "ws"
+	}
+	encoded := base64.URLEncoding.EncodeToString([]byte(target.String()))
+	return scheme + "://" + host + o.basePath + encoded, true
+}
+
+// loadsDirectly reports whether u is left to load directly, not through the
+// proxy, because it is on another host than the page's; see sameOriginOnly.
+func (o *rewriteOptions) loadsDirectly(u *url.URL) bool {
+	return o.pageHost != "" && !strings.EqualFold(u.Host, o.pageHost)
+}
+
+// isProxyURL reports whether u is on the proxy's origin, under its base path.
+func (o *rewriteOptions) isProxyURL(u *url.URL) bool {
+	return strings.EqualFold(u.Scheme+"://"+u.Host, o.origin) && strings.HasPrefix(u.Path, o.basePath)
+}
+
+// resolveURL resolves the reference ref, as found in a page, against base
+// the way a browser does: surrounding whitespace and embedded tabs and
+// newlines are ignored, and backslashes in a leading run of slashes count as
+// slashes. A protocol-relative reference such as "//cdn.example.com/x.js"
+// therefore takes base's scheme even when written as " //cdn..." or
+// "\\cdn...", instead of being taken for a path. Only http and https results
+// are returned; other schemes (mailto:, javascript:, ...) are an error since
+// they can't be proxied.
+func resolveURL(base *url.URL, ref string) (*url.URL, error) {
+	ref = strings.Trim(ref, "\x00\t\n\f\r ")
+	ref = strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(ref)
+	slashes := len(ref) - len(strings.TrimLeft(ref, "/\\"))
+	ref = strings.Repeat("/", slashes) + ref[slashes:]
+
+	resolved, err := base.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	if slashes >= 2 {
+		resolved.Scheme = base.Scheme
+	}
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return nil, fmt.Errorf("cannot proxy %s URL %q", resolved.Scheme, ref)
+	}
+	return resolved, nil
+}
+
+// rewriteFunc rewrites the URLs in a response body, resolving relative ones
+// against base.
+type rewriteFunc func(content []byte, base *url.URL, opts *rewriteOptions) ([]byte, error)
+
+// contentRewriter is the rewriter for one kind of content.
+type contentRewriter struct {
+	name    string // used in logs, errors and metrics, e.g. "HTML"
+	rewrite rewriteFunc
+}
+
+var (
+	htmlRewriter     = &contentRewriter{"HTML", rewriteHTML}
+	cssRewriter      = &contentRewriter{"CSS", rewriteCSS}
+	jsRewriter       = &contentRewriter{"JavaScript", rewriteJS}
+	jsonRewriter     = &contentRewriter{"JSON", rewriteJSON}
+	xmlRewriter      = &contentRewriter{"XML", rewriteXML}
+	manifestRewriter = &contentRewriter{"manifest", rewriteManifest}
+)
+
+// rewritersByName maps the rewriter names accepted in
+// Options.RewriteTypes to the rewriters.
+var rewritersByName = map[string]*contentRewriter{
+	"html":       htmlRewriter,
+	"css":        cssRewriter,
+	"javascript": jsRewriter,
+	"json":       jsonRewriter,
+	"xml":        xmlRewriter,
+	"manifest":   manifestRewriter,
+}
+
+// defaultRewriteTypes maps the media types rewritten in browse mode to
+// their rewriters. JSON is only added with Options.RewriteJSON.
+var defaultRewriteTypes = map[string]*contentRewriter{
+	"text/html":                 htmlRewriter,
+	"application/xhtml+xml":     htmlRewriter,
+	"text/css":                  cssRewriter,
+	"text/javascript":           jsRewriter,
+	"application/javascript":    jsRewriter,
+	"application/x-javascript":  jsRewriter,
+	"application/ecmascript":    jsRewriter,
+	"text/ecmascript":           jsRewriter,
+	"application/rss+xml":       xmlRewriter,
+	"application/atom+xml":      xmlRewriter,
+	"application/xml":           xmlRewriter,
+	"image/svg+xml":             xmlRewriter,
+	"application/manifest+json": manifestRewriter,
+}
+
+// mediaType returns the lowercased media type of a Content-Type value,
+// without its parameters.
+func mediaType(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// rewriterFor returns the rewriter for a response with the given
+// Content-Type, or nil if such responses are passed through unchanged.
+func (p *Proxy) rewriterFor(contentType string) *contentRewriter {
+	return p.rewriters[mediaType(contentType)]
+}
+
+// buildRewriters returns the media type to rewriter mapping for the
+// options: the defaults, JSON if RewriteJSON is set, then RewriteTypes.
+func (p *Proxy) buildRewriters() map[string]*contentRewriter {
+	rewriters := make(map[string]*contentRewriter)
+	for mediaType, rewriter := range defaultRewriteTypes {
+		rewriters[mediaType] = rewriter
+	}
+	if p.RewriteJSON {
+		rewriters["application/json"] = jsonRewriter
+	}
+	for contentType, name := range p.RewriteTypes {
+		if name == "" {
+			delete(rewriters, mediaType(contentType))
+			continue
+		}
+		rewriter, ok := rewritersByName[strings.ToLower(name)]
+		if !ok {
+			p.Logger.Printf("Ignoring unknown rewriter %q for %s", name, contentType)
+			continue
+		}
+		rewriters[mediaType(contentType)] = rewriter
+	}
+	return rewriters
+}
+
+// attrSets turns Options.ExtraURLAttrs into sets of lowercase names, the
+// way the HTML parser reports elements and attributes.
+func attrSets(attrs map[string][]string) map[string]map[string]bool {
+	sets := make(map[string]map[string]bool)
+	for element, names := range attrs {
+		element = strings.ToLower(element)
+		if sets[element] == nil {
+			sets[element] = make(map[string]bool)
+		}
+		for _, name := range names {
+			sets[element][strings.ToLower(name)] = true
+		}
+	}
+	return sets
+}
+
 // rewriteHTML parses the HTML content, traverses the nodes, and for attributes
 // such as href, src, action, and formaction, resolves the URL relative to the base URL,
 // then rewrites the attribute to use the proxy's path ("/" + base64(encodedURL)).
-func rewriteHTML(htmlContent []byte, base *url.URL, origin string) ([]byte, error) {
+func rewriteHTML(htmlContent []byte, base *url.URL, opts *rewriteOptions) ([]byte, error) {
 	doc, err := html.Parse(bytes.NewReader(htmlContent))
 	if err != nil {
 		return nil, err
 	}
 
+	// Restrict rewriting to the page's host, in inline styles and scripts
+	// too. A document in a srcdoc keeps its parent's host.
+	if opts.sameOriginOnly && opts.pageHost == "" {
+		pageOpts := *opts
+		pageOpts.pageHost = base.Host
+		opts = &pageOpts
+	}
+
+	// A <base href> changes what relative URLs resolve against, and it may
+	// come after other elements, so find it before rewriting anything.
+	base = documentBase(doc, base)
+
 	// Attributes to rewrite.
 	rewriteAttrs := map[string]bool{
 		"href":       true,
 		"src":        true,
 		"action":     true,
 		"formaction": true,
+		"poster":     true, // <video>
+		"data":       true, // <object>
+		"cite":       true, // <blockquote>, <q>, <del>, <ins>
+		"background": true, // legacy <body>, <table>, <td>
+	}
+
+	// rewriteRef returns what the URL attribute value ref is rewritten to,
+	// and whether it now goes through the proxy.
+	rewriteRef := func(ref string) (string, bool) {
+		// Do not rewrite data URIs.
+		if strings.HasPrefix(ref, "data:") {
+			return ref, false
+		}
+		// Resolve attribute value relative to the base URL.
+		resolved, err := resolveURL(base, ref)
+		switch {
+		case err != nil:
+			return ref, false
+		case opts.loadsDirectly(resolved):
+			// Loaded directly, so made absolute in case it was relative
+			// to a <base href>.
+			return resolved.String(), false
+		default:
+			return opts.proxyURL(resolved), true
+		}
+	}
+
+	// submitsThroughProxy reports whether the form n submits to a proxy URL.
+	submitsThroughProxy := func(n *html.Node) bool {
+		action := strings.TrimSpace(attrValue(n, "action"))
+		if action == "" {
+			return true
+		}
+		_, proxied := rewriteRef(action)
+		return proxied
 	}
 
 	// traverse recursively walks the HTML node tree and rewrites URL attributes.
@@ -34,42 +297,160 @@ func rewriteHTML(htmlContent []byte, base *url.URL, origin string) ([]byte, erro
 		if n.Type == html.ElementNode {
 			// Process inline <script> tags.
 			if n.Data == "script" {
-				// If there is no src attribute, it's inline.
+				// If there is no src attribute, it's inline. JSON-LD
+				// structured data is JSON, not JavaScript.
 				hasSrc := false
+				rewrite := rewriteJS
 				for _, attr := range n.Attr {
-					if strings.ToLower(attr.Key) == "src" {
+					switch strings.ToLower(attr.Key) {
+					case "src":
 						hasSrc = true
-						break
+					case "type":
+						if mediaType(attr.Val) == "application/ld+json" {
+							rewrite = rewriteJSONLD
+						}
 					}
 				}
 				if !hasSrc {
 					// Process all text nodes inside the script tag.
 					for c := n.FirstChild; c != nil; c = c.NextSibling {
 						if c.Type == html.TextNode {
-							rewritten, err := rewriteJS([]byte(c.Data), base, origin)
+							rewritten, err := rewrite([]byte(c.Data), base, opts)
 							if err == nil {
 								c.Data = string(rewritten)
 							} else {
-								log.Printf("Error rewriting inline script: %v", err)
+								opts.logger.Printf("Error rewriting inline script: %v", err)
 							}
 						}
 					}
 				}
 			}
 
+			// Process inline <style> blocks, including their @import rules.
+			if n.Data == "style" {
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					if c.Type == html.TextNode {
+						c.Data = rewriteCSSText(c.Data, base, opts)
+					}
+				}
+			}
+
+			// The parser keeps <noscript> content as raw text, since it
+			// assumes scripting is on, so parse it as markup to rewrite it.
+			if n.Data == "noscript" {
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					if c.Type != html.TextNode {
+						continue
+					}
+					nodes, err := html.ParseFragment(strings.NewReader(c.Data), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+					if err != nil {
+						opts.logger.Printf("Error parsing noscript content: %v", err)
+						continue
+					}
+					var buf bytes.Buffer
+					for _, node := range nodes {
+						traverse(node)
+						if err := html.Render(&buf, node); err != nil {
+							break
+						}
+					}
+					c.Data = buf.String()
+				}
+			}
+
+			// A GET form replaces the query of its action with its fields,
+			// dropping the browse flag, so submit the flag as a field too.
+			// Only a form that submits through the proxy needs it: one
+			// without an action submits to this page, and one whose action
+			// is left to load directly would send the flag to a third party.
+			if n.Data == "form" && (attrValue(n, "method") == "" || strings.EqualFold(attrValue(n, "method"), "get")) && submitsThroughProxy(n) {
+				n.AppendChild(&html.Node{
+					Type:     html.ElementNode,
+					Data:     "input",
+					DataAtom: atom.Input,
+					Attr: []html.Attribute{
+						{Key: "type", Val: "hidden"},
+						{Key: "name", Val: opts.browseParam},
+						{Key: "value", Val: "1"},
+					},
+				})
+			}
+
+			// The document is written back as UTF-8, whatever it was in.
+			if n.Data == "meta" {
+				setMetaCharset(n)
+			}
+
+			// Keep <meta http-equiv="refresh"> redirects inside the proxy.
+			if n.Data == "meta" && strings.EqualFold(attrValue(n, "http-equiv"), "refresh") {
+				for i, attr := range n.Attr {
+					if strings.ToLower(attr.Key) == "content" {
+						n.Attr[i].Val = rewriteRefresh(attr.Val, base, opts)
+					}
+				}
+			}
+
+			rewritten := false
 			for i, attr := range n.Attr {
-				if rewriteAttrs[strings.ToLower(attr.Key)] {
-					// Do not rewrite data URIs.
-					if strings.HasPrefix(attr.Val, "data:") {
+				// An iframe's srcdoc is a whole document that resolves URLs
+				// against this one. The parser has already decoded its
+				// entities, and rendering encodes them again.
+				if strings.ToLower(attr.Key) == "srcdoc" {
+					if doc, err := rewriteHTML([]byte(attr.Val), base, opts); err == nil {
+						n.Attr[i].Val = string(doc)
+					} else {
+						opts.logger.Printf("Error rewriting srcdoc: %v", err)
+					}
+					continue
+				}
+				// Inline styles get the same treatment as stylesheets.
+				if strings.ToLower(attr.Key) == "style" {
+					n.Attr[i].Val = rewriteCSSText(attr.Val, base, opts)
+					continue
+				}
+				// An empty action or formaction submits to the current page,
+				// which is already a proxy URL, and a dialog form only
+				// closes its dialog, so those are left alone.
+				switch strings.ToLower(attr.Key) {
+				case "action":
+					if strings.TrimSpace(attr.Val) == "" || strings.EqualFold(attrValue(n, "method"), "dialog") {
 						continue
 					}
-					// Resolve attribute value relative to the base URL.
-					resolved, err := base.Parse(attr.Val)
-					if err == nil {
-						encoded := base64.URLEncoding.EncodeToString([]byte(resolved.String()))
-						n.Attr[i].Val = origin + "/" + encoded + "?browse=1"
+				case "formaction":
+					if strings.TrimSpace(attr.Val) == "" || strings.EqualFold(attrValue(n, "formmethod"), "dialog") {
+						continue
 					}
 				}
+				// Responsive images, as on <img> and the <source>s of a
+				// <picture>, list several candidate URLs.
+				if key := strings.ToLower(attr.Key); key == "srcset" || key == "imagesrcset" {
+					n.Attr[i].Val = rewriteSrcset(attr.Val, func(ref string) string {
+						ref, proxied := rewriteRef(ref)
+						rewritten = rewritten || proxied
+						return ref
+					})
+					continue
+				}
+				// In SVG, a fragment-only reference such as <use
+				// href="#icon"> or a gradient's xlink:href names an element
+				// of this document, so it stays as it is.
+				if n.Namespace == "svg" && strings.HasPrefix(strings.TrimSpace(attr.Val), "#") {
+					continue
+				}
+				// The parser splits xlink:href into the xlink namespace and
+				// the key href, and renders it back the same way, so it is
+				// rewritten as href.
+				if key := strings.ToLower(attr.Key); rewriteAttrs[key] || opts.extraAttrs[n.Data][key] {
+					val, proxied := rewriteRef(attr.Val)
+					n.Attr[i].Val = val
+					rewritten = rewritten || proxied
+				}
+			}
+
+			// The proxied subresource may itself be rewritten, so its
+			// integrity hash no longer holds, and it is now same-origin.
+			if rewritten && (n.Data == "script" || n.Data == "link") {
+				removeAttrs(n, "integrity", "crossorigin")
 			}
 		}
 		for c := n.FirstChild; c != nil; c = c.NextSibling {
@@ -87,118 +468,562 @@ func rewriteHTML(htmlContent []byte, base *url.URL, origin string) ([]byte, erro
 	return buf.Bytes(), nil
 }
 
+// removeAttrs deletes the named attributes from n.
+func removeAttrs(n *html.Node, keys ...string) {
+	kept := n.Attr[:0]
+	for _, attr := range n.Attr {
+		drop := false
+		for _, key := range keys {
+			if strings.EqualFold(attr.Key, key) {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			kept = append(kept, attr)
+		}
+	}
+	n.Attr = kept
+}
+
+// attrValue returns the value of n's attribute key, or "" if it has none.
+func attrValue(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// rewriteRefresh rewrites the URL in a refresh value such as
+// "3;url=/next" through the proxy, keeping the delay. Values without a URL
+// are returned unchanged.
+func rewriteRefresh(value string, base *url.URL, opts *rewriteOptions) string {
+	sep := strings.IndexAny(value, ";,")
+	if sep < 0 {
+		return value
+	}
+	delay, target := value[:sep], strings.TrimSpace(value[sep+1:])
+	if len(target) >= 3 && strings.EqualFold(target[:3], "url") {
+		if rest := strings.TrimSpace(target[3:]); strings.HasPrefix(rest, "=") {
+			target = strings.TrimSpace(rest[1:])
+		}
+	}
+	if len(target) >= 2 && (target[0] == '\'' || target[0] == '"') && target[len(target)-1] == target[0] {
+		target = target[1 : len(target)-1]
+	}
+	if target == "" {
+		return value
+	}
+	resolved, err := resolveURL(base, target)
+	if err != nil {
+		return value
+	}
+	return delay + ";url=" + opts.proxyURL(resolved)
+}
+
+// rewriteSrcset passes each candidate URL of a srcset value, such as
+// "a.jpg 1x, b.jpg 2x", through rewrite, keeping the descriptors. It splits
+// candidates the way browsers do, so commas inside URLs, as in
+// "/img/w_100,h_50/a.jpg", do not end them.
+func rewriteSrcset(value string, rewrite func(string) string) string {
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+	var candidates []string
+	i := 0
+	for {
+		for i < len(value) && (isSpace(value[i]) || value[i] == ',') {
+			i++
+		}
+		if i == len(value) {
+			break
+		}
+		start := i
+		for i < len(value) && !isSpace(value[i]) {
+			i++
+		}
+		ref := value[start:i]
+		// Commas ending the URL separate it from the next candidate.
+		if trimmed := strings.TrimRight(ref, ","); trimmed != ref {
+			candidates = append(candidates, rewrite(trimmed))
+			continue
+		}
+		// The descriptors run to the next comma outside parentheses.
+		start, depth := i, 0
+		for ; i < len(value); i++ {
+			if value[i] == '(' {
+				depth++
+			} else if value[i] == ')' && depth > 0 {
+				depth--
+			} else if value[i] == ',' && depth == 0 {
+				break
+			}
+		}
+		candidate := rewrite(ref)
+		if descriptors := strings.TrimSpace(value[start:i]); descriptors != "" {
+			candidate += " " + descriptors
+		}
+		candidates = append(candidates, candidate)
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// documentBase returns the URL that relative references in doc resolve
+// against: the first <base href> resolved against base, or base itself.
+func documentBase(doc *html.Node, base *url.URL) *url.URL {
+	var find func(*html.Node) *url.URL
+	find = func(n *html.Node) *url.URL {
+		if n.Type == html.ElementNode && n.Data == "base" {
+			for _, attr := range n.Attr {
+				if strings.ToLower(attr.Key) == "href" {
+					if resolved, err := resolveURL(base, attr.Val); err == nil {
+						return resolved
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if found := find(c); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	if found := find(doc); found != nil {
+		return found
+	}
+	return base
+}
+
+// Patterns for URL references in CSS.
+var (
+	cssURLRegex    = regexp.MustCompile(`url\(\s*(["']?)([^"')]+)(["']?)\s*\)`)
+	cssImportRegex = regexp.MustCompile(`@import\s+(["'])([^"']+)(["'])`)
+	// cssImageSetRegex matches the start of image-set(), whose images may be
+	// plain strings rather than url(...).
+	cssImageSetRegex = regexp.MustCompile(`(?i)(?:-webkit-)?image-set\(`)
+	// cssStringRegex matches a string literal, noting a function such as
+	// url( or type( that it is the argument of.
+	cssStringRegex = regexp.MustCompile(`([\w-]+\(\s*)?(["'])([^"']*)(["'])`)
+)
+
 // rewriteCSS rewrites URLs in CSS content, such as those in url(...) and @import rules.
-func rewriteCSS(content []byte, base *url.URL, origin string) ([]byte, error) {
-	text := string(content)
+func rewriteCSS(content []byte, base *url.URL, opts *rewriteOptions) ([]byte, error) {
+	return []byte(rewriteCSSText(string(content), base, opts)), nil
+}
+
+// rewriteCSSText rewrites the url(...) and @import references in a CSS
+// stylesheet or declaration list, such as the value of a style attribute.
+func rewriteCSSText(text string, base *url.URL, opts *rewriteOptions) string {
+	// Rewrite the strings in image-set("a.png" 1x, url(b.png) 2x). Its
+	// url(...) references are left for below, and descriptors such as 1x
+	// and type("image/avif") are kept.
+	text = rewriteImageSets(text, base, opts)
 
 	// Rewrite url(...) references.
-	urlRegex := regexp.MustCompile(`url\(\s*(["']?)([^"')]+)(["']?)\s*\)`)
-	text = urlRegex.ReplaceAllStringFunc(text, func(match string) string {
-		submatches := urlRegex.FindStringSubmatch(match)
+	text = cssURLRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := cssURLRegex.FindStringSubmatch(match)
 		if len(submatches) < 3 {
 			return match
 		}
 		quote := submatches[1]
 		urlPart := submatches[2]
-		resolved, err := base.Parse(urlPart)
+		// Embedded data, same-document references such as url(#gradient),
+		// and about: URLs must stay as they are.
+		if isLocalRef(urlPart) {
+			return match
+		}
+		resolved, err := resolveURL(base, urlPart)
 		if err != nil {
 			return match
 		}
-		encoded := base64.URLEncoding.EncodeToString([]byte(resolved.String()))
-		return "url(" + quote + origin + "/" + encoded + "?browse=1" + quote + ")"
+		return "url(" + quote + opts.proxyURL(resolved) + quote + ")"
 	})
 
 	// Rewrite @import statements.
-	importRegex := regexp.MustCompile(`@import\s+(["'])([^"']+)(["'])`)
-	text = importRegex.ReplaceAllStringFunc(text, func(match string) string {
-		submatches := importRegex.FindStringSubmatch(match)
+	text = cssImportRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := cssImportRegex.FindStringSubmatch(match)
 		if len(submatches) < 3 {
 			return match
 		}
 		quote := submatches[1]
 		urlPart := submatches[2]
-		resolved, err := base.Parse(urlPart)
+		resolved, err := resolveURL(base, urlPart)
 		if err != nil {
 			return match
 		}
-		encoded := base64.URLEncoding.EncodeToString([]byte(resolved.String()))
-		return "@import " + quote + origin + "/" + encoded + "?browse=1" + quote
+		return "@import " + quote + opts.proxyURL(resolved) + quote
 	})
 
-	return []byte(text), nil
+	return text
+}
+
+// rewriteImageSets rewrites the URLs given as plain strings in the
+// image-set() and -webkit-image-set() functions of text.
+func rewriteImageSets(text string, base *url.URL, opts *rewriteOptions) string {
+	var out strings.Builder
+	for {
+		loc := cssImageSetRegex.FindStringIndex(text)
+		if loc == nil {
+			break
+		}
+		end := cssArgsEnd(text, loc[1])
+		out.WriteString(text[:loc[1]])
+		out.WriteString(cssStringRegex.ReplaceAllStringFunc(text[loc[1]:end], func(match string) string {
+			submatches := cssStringRegex.FindStringSubmatch(match)
+			if len(submatches) < 5 {
+				return match
+			}
+			function, openQuote, ref, closeQuote := submatches[1], submatches[2], submatches[3], submatches[4]
+			if function != "" || openQuote != closeQuote || isLocalRef(ref) {
+				return match
+			}
+			resolved, err := resolveURL(base, ref)
+			if err != nil {
+				return match
+			}
+			return openQuote + opts.proxyURL(resolved) + closeQuote
+		}))
+		text = text[end:]
+	}
+	out.WriteString(text)
+	return out.String()
+}
+
+// cssArgsEnd returns the index of the ")" that closes the function arguments
+// starting at text[i], or len(text) if there is none.
+func cssArgsEnd(text string, i int) int {
+	depth := 1
+	for ; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			if end := strings.IndexByte(text[i+1:], text[i]); end >= 0 {
+				i += end + 1
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(text)
+}
+
+// isLocalRef reports whether ref is a data: URI, an about: URL, or a
+// fragment-only reference, none of which point at an upstream resource.
+func isLocalRef(ref string) bool {
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	return strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "about:")
 }
 
-// rewriteJS rewrites absolute URL references in JavaScript string literals.
-func rewriteJS(content []byte, base *url.URL, origin string) ([]byte, error) {
-	text := string(content)
+// Patterns for the URL references rewriteJS understands.
+var (
+	// jsAbsURLRegex matches string literals starting with "http" or "https".
+	jsAbsURLRegex       = regexp.MustCompile(`(["'])(https?://[^"']+)(["'])`)
+	jsRelImportRegex    = regexp.MustCompile(`import\(\s*(["'])(\.{1,2}\/[^"']+)(["'])`)
+	jsStaticImportRegex = regexp.MustCompile(`from\s*(["'])(\.{1,2}\/[^"']+)(["'])`)
+	jsFetchRegex        = regexp.MustCompile(`\bfetch\(\s*(["'])(\/[^"']*)(["'])`)
+	jsXHROpenRegex      = regexp.MustCompile(`\.open\(\s*(["'][A-Za-z]+["'])\s*,\s*(["'])(\/[^"']*)(["'])`)
+	jsURLFuncRegex      = regexp.MustCompile(`URL\(\s*(["'])(\/[^"']*)(["'])\s*\)`)
+	// jsWebSocketRegex matches absolute URLs passed to the WebSocket
+	// constructor, which jsAbsURLRegex leaves alone.
+	jsWebSocketRegex = regexp.MustCompile(`\bWebSocket\(\s*(["'])(wss?://[^"']+)(["'])`)
+	// jsAJAXRegex matches root-relative URLs passed to common AJAX
+	// helpers, axios.get("/api") or $.post("/api"), or given as the url
+	// option of one, as in $.ajax({url: "/api"}). It is only used with
+	// Options.RewriteAJAX.
+	jsAJAXRegex = regexp.MustCompile(`((?:\baxios\.(?:get|post|put|patch|delete|head|options|request)|(?:\$|\bjQuery)\.(?:get|post|getJSON|ajax))\(\s*|\burl\s*:\s*)(["'])(\/[^"']*)(["'])`)
+	// jsLocationRegex matches string literals assigned to location or
+	// location.href, such as window.location.href = "/next". Only a bare
+	// location, window.location or document.location counts, so a property
+	// like item.location is left alone, and requiring the quote right after
+	// "=" keeps comparisons like location == "x" out. A declaration such as
+	// let location = "x" is matched too, with its keyword, so that it can
+	// be told apart: it names a local variable.
+	jsLocationRegex = regexp.MustCompile(`(^|[^\w$.])(\b(?:var|let|const)\s+)?((?:window|document)\.)?location(\.href)?\s*=\s*(["'])([^"']+)(["'])`)
+)
+
+// rewriteJS rewrites URL references in JavaScript string literals. Template
+// literals, regular expression literals and comments are left as they are:
+// a regex that happens to contain "http://" must not be turned into a syntax
+// error, and a template's substitutions can't be rewritten safely.
+func rewriteJS(content []byte, base *url.URL, opts *rewriteOptions) ([]byte, error) {
+	text := mapJSCode(string(content), func(code string) string {
+		return rewriteJSCode(code, base, opts)
+	})
+	return []byte(text), nil
+}
 
-	// This regex matches string literals starting with "http" or "https"
-	absRegex := regexp.MustCompile(`(["'])(https?://[^"']+)(["'])`)
-	text = absRegex.ReplaceAllStringFunc(text, func(match string) string {
-		submatches := absRegex.FindStringSubmatch(match)
+// rewriteJSCode rewrites the URL references in a stretch of JavaScript that
+// holds no template literals, regular expressions or comments.
+func rewriteJSCode(text string, base *url.URL, opts *rewriteOptions) string {
+	// Rewrite absolute URLs.
+	text = jsAbsURLRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := jsAbsURLRegex.FindStringSubmatch(match)
 		if len(submatches) < 4 {
 			return match
 		}
 		openQuote := submatches[1]
 		urlPart := submatches[2]
 		closeQuote := submatches[3]
-		resolved, err := base.Parse(urlPart)
+		resolved, err := resolveURL(base, urlPart)
 		if err != nil {
 			return match
 		}
-		encoded := base64.URLEncoding.EncodeToString([]byte(resolved.String()))
-		return openQuote + origin + "/" + encoded + "?browse=1" + closeQuote
+		return openQuote + opts.proxyURL(resolved) + closeQuote
 	})
 
 	// Rewrite dynamic imports with relative paths.
-	relImportRegex := regexp.MustCompile(`import\(\s*(["'])(\.{1,2}\/[^"']+)(["'])`)
-	text = relImportRegex.ReplaceAllStringFunc(text, func(match string) string {
-		submatches := relImportRegex.FindStringSubmatch(match)
+	text = jsRelImportRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := jsRelImportRegex.FindStringSubmatch(match)
 		if len(submatches) < 4 {
 			return match
 		}
 		openQuote := submatches[1]
 		relPath := submatches[2]
 		closeQuote := submatches[3]
-		resolved, err := base.Parse(relPath)
+		resolved, err := resolveURL(base, relPath)
 		if err != nil {
 			return match
 		}
-		encoded := base64.URLEncoding.EncodeToString([]byte(resolved.String()))
 		// Note: The regex stops before the closing parenthesis.
-		return "import(" + openQuote + origin + "/" + encoded + "?browse=1" + closeQuote
+		return "import(" + openQuote + opts.proxyURL(resolved) + closeQuote
 	})
 
-	// Rewrite static import statements
-	// Match static import statements in the form: from "..."
-	staticImportRegex := regexp.MustCompile(`from\s*(["'])(\.{1,2}\/[^"']+)(["'])`)
-	text = staticImportRegex.ReplaceAllStringFunc(text, func(match string) string {
-		submatches := staticImportRegex.FindStringSubmatch(match)
+	// Rewrite static import statements in the form: from "..."
+	text = jsStaticImportRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := jsStaticImportRegex.FindStringSubmatch(match)
 		if len(submatches) < 4 {
 			return match
 		}
 		openQuote, importPath, closeQuote := submatches[1], submatches[2], submatches[3]
-		resolved, err := base.Parse(importPath)
+		resolved, err := resolveURL(base, importPath)
+		if err != nil {
+			return match
+		}
+		return "from " + openQuote + opts.proxyURL(resolved) + closeQuote
+	})
+
+	// Rewrite root-relative fetch calls: fetch("/api/data")
+	text = jsFetchRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := jsFetchRegex.FindStringSubmatch(match)
+		if len(submatches) < 4 {
+			return match
+		}
+		openQuote, path, closeQuote := submatches[1], submatches[2], submatches[3]
+		resolved, err := resolveURL(base, path)
+		if err != nil {
+			return match
+		}
+		// Note: The regex stops before any further arguments.
+		return "fetch(" + openQuote + opts.proxyURL(resolved) + closeQuote
+	})
+
+	// Rewrite root-relative XMLHttpRequest calls: xhr.open("GET", "/api")
+	text = jsXHROpenRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := jsXHROpenRegex.FindStringSubmatch(match)
+		if len(submatches) < 5 {
+			return match
+		}
+		method, openQuote, path, closeQuote := submatches[1], submatches[2], submatches[3], submatches[4]
+		resolved, err := resolveURL(base, path)
+		if err != nil {
+			return match
+		}
+		return ".open(" + method + ", " + openQuote + opts.proxyURL(resolved) + closeQuote
+	})
+
+	// Rewrite relative navigations: location.href = "/next". Absolute ones
+	// were rewritten with the other absolute URLs above.
+	text = jsLocationRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := jsLocationRegex.FindStringSubmatch(match)
+		if len(submatches) < 8 {
+			return match
+		}
+		prefix, declaration, object, href := submatches[1], submatches[2], submatches[3], submatches[4]
+		openQuote, ref, closeQuote := submatches[5], submatches[6], submatches[7]
+		if declaration != "" || strings.Contains(ref, "://") || isLocalRef(ref) {
+			return match
+		}
+		resolved, err := resolveURL(base, ref)
 		if err != nil {
 			return match
 		}
-		encoded := base64.URLEncoding.EncodeToString([]byte(resolved.String()))
-		newURL := origin + "/" + encoded + "?browse=1"
-		return "from " + openQuote + newURL + closeQuote
+		return prefix + object + "location" + href + " = " + openQuote + opts.proxyURL(resolved) + closeQuote
 	})
 
+	// Rewrite WebSocket connections: new WebSocket("wss://host/ws")
+	text = jsWebSocketRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := jsWebSocketRegex.FindStringSubmatch(match)
+		if len(submatches) < 4 {
+			return match
+		}
+		openQuote, ref, closeQuote := submatches[1], submatches[2], submatches[3]
+		target, err := url.Parse(ref)
+		if err != nil || target.Host == "" {
+			return match
+		}
+		proxied, ok := opts.webSocketURL(target)
+		if !ok {
+			return match
+		}
+		// Note: The regex stops before any further arguments.
+		return "WebSocket(" + openQuote + proxied + closeQuote
+	})
+
+	// Rewrite AJAX helper calls, if enabled: axios.get("/api/items")
+	if opts.rewriteAJAX {
+		text = jsAJAXRegex.ReplaceAllStringFunc(text, func(match string) string {
+			submatches := jsAJAXRegex.FindStringSubmatch(match)
+			if len(submatches) < 5 {
+				return match
+			}
+			prefix, openQuote, path, closeQuote := submatches[1], submatches[2], submatches[3], submatches[4]
+			resolved, err := resolveURL(base, path)
+			if err != nil {
+				return match
+			}
+			return prefix + openQuote + opts.proxyURL(resolved) + closeQuote
+		})
+	}
+
 	// Rewrite URL function calls: URL("/blabla") -> URL("https://proxy.hilmy.dev/blabla")
-	urlFuncRegex := regexp.MustCompile(`URL\(\s*(["'])(\/[^"']*)(["'])\s*\)`)
-	text = urlFuncRegex.ReplaceAllStringFunc(text, func(match string) string {
-		submatches := urlFuncRegex.FindStringSubmatch(match)
+	text = jsURLFuncRegex.ReplaceAllStringFunc(text, func(match string) string {
+		submatches := jsURLFuncRegex.FindStringSubmatch(match)
 		if len(submatches) < 4 {
 			return match
 		}
 		openQuote := submatches[1]
 		relPath := submatches[2] // this is the relative path (starting with "/")
 		closeQuote := submatches[3]
-		return "URL(" + openQuote + origin + relPath + closeQuote + ")"
+		return "URL(" + openQuote + opts.origin + relPath + closeQuote + ")"
 	})
 
-	return []byte(text), nil
+	return text
+}
+
+// rewriteJSON rewrites every string value in a JSON document that is an
+// absolute http(s) URL. Object keys, numbers and all other values keep their
+// types; object members are re-marshaled in key order.
+func rewriteJSON(content []byte, base *url.URL, opts *rewriteOptions) ([]byte, error) {
+	return rewriteJSONDocument(content, base, opts, false)
+}
+
+// rewriteJSONLD rewrites JSON-LD structured data like rewriteJSON, except
+// for the values of keywords such as @context and @id: those URLs name
+// vocabularies and things rather than locating resources. The result goes
+// back into a <script> element, so every "</" is escaped as "<\/" to keep
+// the data from closing it.
+func rewriteJSONLD(content []byte, base *url.URL, opts *rewriteOptions) ([]byte, error) {
+	rewritten, err := rewriteJSONDocument(content, base, opts, true)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.ReplaceAll(rewritten, []byte("</"), []byte(`<\/`)), nil
+}
+
+func rewriteJSONDocument(content []byte, base *url.URL, opts *rewriteOptions, skipKeywords bool) ([]byte, error) {
+	var doc any
+	if err := decodeJSON(content, &doc); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(rewriteJSONValue(doc, base, opts, skipKeywords)); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// decodeJSON decodes content, keeping numbers as they are written, into v.
+// Anything after the first JSON value is an error rather than being dropped
+// from the rewritten document, so the caller keeps the original.
+func decodeJSON(content []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return errors.New("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// rewriteManifest rewrites the URLs in a web app manifest: start_url, the
+// src of icons and screenshots, and the url and icons of shortcuts. Unlike
+// in rewriteJSON, relative URLs are rewritten too. The scope becomes the
+// whole proxy, since the encoded URLs under a scope don't share its prefix.
+func rewriteManifest(content []byte, base *url.URL, opts *rewriteOptions) ([]byte, error) {
+	var manifest map[string]any
+	if err := decodeJSON(content, &manifest); err != nil {
+		return nil, err
+	}
+
+	rewriteMember := func(obj map[string]any, key string) {
+		if ref, ok := obj[key].(string); ok {
+			if resolved, err := resolveURL(base, ref); err == nil {
+				obj[key] = opts.proxyURL(resolved)
+			}
+		}
+	}
+	rewriteImages := func(obj map[string]any, key string) {
+		images, _ := obj[key].([]any)
+		for _, image := range images {
+			if image, ok := image.(map[string]any); ok {
+				rewriteMember(image, "src")
+			}
+		}
+	}
+	rewriteMember(manifest, "start_url")
+	if _, ok := manifest["scope"]; ok {
+		manifest["scope"] = opts.origin + opts.basePath
+	}
+	rewriteImages(manifest, "icons")
+	rewriteImages(manifest, "screenshots")
+	shortcuts, _ := manifest["shortcuts"].([]any)
+	for _, shortcut := range shortcuts {
+		if shortcut, ok := shortcut.(map[string]any); ok {
+			rewriteMember(shortcut, "url")
+			rewriteImages(shortcut, "icons")
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(manifest); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// rewriteJSONValue rewrites the URL strings within a decoded JSON value,
+// leaving the members whose keys start with "@" alone if skipKeywords is set.
+func rewriteJSONValue(v any, base *url.URL, opts *rewriteOptions, skipKeywords bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, elem := range v {
+			if skipKeywords && strings.HasPrefix(key, "@") {
+				continue
+			}
+			v[key] = rewriteJSONValue(elem, base, opts, skipKeywords)
+		}
+	case []any:
+		for i, elem := range v {
+			v[i] = rewriteJSONValue(elem, base, opts, skipKeywords)
+		}
+	case string:
+		lower := strings.ToLower(v)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+			if resolved, err := resolveURL(base, v); err == nil {
+				return opts.proxyURL(resolved)
+			}
+		}
+	}
+	return v
 }
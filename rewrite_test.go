@@ -0,0 +1,850 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testOrigin is the proxy origin used by testOptions.
+const testOrigin = "http://proxy.test"
+
+// testOptions returns rewrite options for a proxy at testOrigin + "/".
+func testOptions() *rewriteOptions {
+	return &rewriteOptions{
+		origin:      testOrigin,
+		basePath:    "/",
+		browseParam: "browse",
+		logger:      log.New(io.Discard, "", 0),
+	}
+}
+
+// proxied returns the browse mode proxy URL of target under testOptions.
+func proxied(target string) string {
+	return testOrigin + "/" + encode(target) + "?browse=1"
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// rewriteTest is a case for a rewriter: in is rewritten as if it came from
+// base, and the output must contain each of want and none of notWant.
+type rewriteTest struct {
+	name    string
+	base    string
+	in      string
+	want    []string
+	notWant []string
+}
+
+func runRewriteTests(t *testing.T, rewrite func([]byte, *url.URL, *rewriteOptions) ([]byte, error), opts func() *rewriteOptions, tests []rewriteTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := tt.base
+			if base == "" {
+				base = "https://example.com/dir/page.html"
+			}
+			out, err := rewrite([]byte(tt.in), mustParse(t, base), opts())
+			if err != nil {
+				t.Fatalf("rewrite: %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(out), want) {
+					t.Errorf("output %q does not contain %q", out, want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(string(out), notWant) {
+					t.Errorf("output %q contains %q", out, notWant)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteHTMLBaseHref(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "base after links",
+			in:   `<a href="a.html">a</a><base href="https://cdn.example.com/assets/"><img src="b.png">`,
+			want: []string{
+				`href="` + proxied("https://cdn.example.com/assets/a.html") + `"`,
+				`src="` + proxied("https://cdn.example.com/assets/b.png") + `"`,
+				`<base href="` + proxied("https://cdn.example.com/assets/") + `"/>`,
+			},
+		},
+		{
+			name: "relative base",
+			in:   `<base href="/other/"><a href="x">x</a>`,
+			want: []string{`href="` + proxied("https://example.com/other/x") + `"`},
+		},
+		{
+			name: "no base",
+			in:   `<a href="x">x</a>`,
+			want: []string{`href="` + proxied("https://example.com/dir/x") + `"`},
+		},
+	})
+}
+
+func TestRewriteCSSLocalRefs(t *testing.T) {
+	font := `url(data:font/woff2;base64,d09GMgABAAAAA)`
+	runRewriteTests(t, rewriteCSS, testOptions, []rewriteTest{
+		{
+			name: "relative url",
+			in:   `.a{background:url("img/a.png")}`,
+			want: []string{`url("` + proxied("https://example.com/dir/img/a.png") + `")`},
+		},
+		{
+			name: "data URI font",
+			in:   `@font-face{src:` + font + `}`,
+			want: []string{font},
+		},
+		{
+			name: "SVG filter fragment",
+			in:   `.b{filter:url(#blur)}`,
+			want: []string{`url(#blur)`},
+		},
+		{
+			name: "about URL",
+			in:   `.c{background:url(about:blank)}`,
+			want: []string{`url(about:blank)`},
+		},
+	})
+}
+
+func TestRewriteHTMLInlineStyle(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "relative url",
+			in:   `<div style="background: url('/img/hero.png') no-repeat">x</div>`,
+			want: []string{`style="background: url(&#39;` + proxied("https://example.com/img/hero.png") + `&#39;) no-repeat"`},
+		},
+		{
+			name: "no url",
+			in:   `<div style="color: red">x</div>`,
+			want: []string{`style="color: red"`},
+		},
+	})
+}
+
+func TestRewriteRefresh(t *testing.T) {
+	base := mustParse(t, "https://example.com/dir/page.html")
+	next := proxied("https://example.com/next")
+	tests := []struct {
+		in, want string
+	}{
+		{"5; url=/next", "5;url=" + next},
+		{"0;URL='/next'", "0;url=" + next},
+		{`3, url="/next"`, "3;url=" + next},
+		{"10", "10"},
+		{"0; url=", "0; url="},
+	}
+	for _, tt := range tests {
+		if got := rewriteRefresh(tt.in, base, testOptions()); got != tt.want {
+			t.Errorf("rewriteRefresh(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteHTMLMetaRefresh(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "meta refresh",
+			in:   `<meta http-equiv="Refresh" content="2; URL=/login">`,
+			want: []string{`content="2;url=` + proxied("https://example.com/login") + `"`},
+		},
+		{
+			name: "other meta",
+			in:   `<meta name="description" content="0; url=/x">`,
+			want: []string{`content="0; url=/x"`},
+		},
+	})
+}
+
+func TestRewriteHTMLStyleBlock(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "relative url",
+			in:   `<style>.hero{background:url(/img.png)}</style>`,
+			want: []string{`<style>.hero{background:url(` + proxied("https://example.com/img.png") + `)}</style>`},
+		},
+		{
+			name: "import",
+			in:   `<style>@import "theme.css"; @import url(print.css) print;</style>`,
+			want: []string{
+				`@import "` + proxied("https://example.com/dir/theme.css") + `";`,
+				`@import url(` + proxied("https://example.com/dir/print.css") + `) print;`,
+			},
+		},
+	})
+}
+
+func TestRewriteHTMLIntegrity(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name:    "script",
+			in:      `<script src="/app.js" integrity="sha384-abc" crossorigin="anonymous"></script>`,
+			want:    []string{`<script src="` + proxied("https://example.com/app.js") + `">`},
+			notWant: []string{"integrity", "crossorigin"},
+		},
+		{
+			name:    "stylesheet",
+			in:      `<link rel="stylesheet" href="/a.css" integrity="sha256-xyz" crossorigin>`,
+			notWant: []string{"integrity", "crossorigin"},
+		},
+		{
+			name: "not rewritten",
+			in:   `<script integrity="sha384-abc" crossorigin="anonymous">inline()</script>`,
+			want: []string{`integrity="sha384-abc"`, `crossorigin="anonymous"`},
+		},
+	})
+}
+
+func TestRewriteJSFetchAndXHR(t *testing.T) {
+	runRewriteTests(t, rewriteJS, testOptions, []rewriteTest{
+		{
+			name: "fetch",
+			in:   `fetch("/api/x").then(r => r.json())`,
+			want: []string{`fetch("` + proxied("https://example.com/api/x") + `")`},
+		},
+		{
+			name: "fetch with options",
+			in:   `fetch( '/api/y', {method: "POST"})`,
+			want: []string{`fetch('` + proxied("https://example.com/api/y") + `', {method: "POST"})`},
+		},
+		{
+			name: "xhr open",
+			in:   `xhr.open("GET", "/api/z?a=1", true)`,
+			want: []string{`.open("GET", "` + proxied("https://example.com/api/z?a=1") + `", true)`},
+		},
+		{
+			name: "relative fetch",
+			in:   `fetch("data.json")`,
+			want: []string{`fetch("data.json")`},
+		},
+		{
+			name: "unrelated open",
+			in:   `window.open("/popup")`,
+			want: []string{`window.open("/popup")`},
+		},
+	})
+}
+
+func TestRewriteHTMLMediaAttributes(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "video poster",
+			in:   `<video poster="/thumb.jpg" src="/movie.mp4"></video>`,
+			want: []string{`poster="` + proxied("https://example.com/thumb.jpg") + `"`},
+		},
+		{
+			name: "object data",
+			in:   `<object data="movie.swf"></object>`,
+			want: []string{`data="` + proxied("https://example.com/dir/movie.swf") + `"`},
+		},
+		{
+			name: "blockquote cite",
+			in:   `<blockquote cite="/source">q</blockquote>`,
+			want: []string{`cite="` + proxied("https://example.com/source") + `"`},
+		},
+		{
+			name: "legacy background",
+			in:   `<table background="bg.gif"></table>`,
+			want: []string{`background="` + proxied("https://example.com/dir/bg.gif") + `"`},
+		},
+		{
+			name: "data URI poster",
+			in:   `<video poster="data:image/png;base64,AAAA"></video>`,
+			want: []string{`poster="data:image/png;base64,AAAA"`},
+		},
+	})
+}
+
+func TestRewriteJSON(t *testing.T) {
+	runRewriteTests(t, rewriteJSON, testOptions, []rewriteTest{
+		{
+			name: "URL fields",
+			in:   `{"image":"https://cdn.example.com/a.png","next":"http://example.com/?page=2","count":3}`,
+			want: []string{
+				`"image":"` + proxied("https://cdn.example.com/a.png") + `"`,
+				`"next":"` + proxied("http://example.com/?page=2") + `"`,
+				`"count":3`,
+			},
+		},
+		{
+			name: "nested and typed",
+			in:   `{"items":[{"url":"https://a.com/x","ok":true,"n":1.50,"v":null}],"path":"/relative"}`,
+			want: []string{
+				`"url":"` + proxied("https://a.com/x") + `"`,
+				`"ok":true`, `"n":1.50`, `"v":null`,
+				`"path":"/relative"`,
+			},
+		},
+	})
+}
+
+func TestRewriteJSONTrailingData(t *testing.T) {
+	rewriters := []struct {
+		name    string
+		rewrite rewriteFunc
+	}{
+		{"JSON", rewriteJSON},
+		{"JSON-LD", rewriteJSONLD},
+		{"manifest", rewriteManifest},
+	}
+	for _, r := range rewriters {
+		for _, in := range []string{`{"a":"https://a.com/"} {"b":1}`, `{"a":"https://a.com/"}]`, `{"a":"https://a.com/"} x`} {
+			if out, err := r.rewrite([]byte(in), mustParse(t, "https://example.com/"), testOptions()); err == nil {
+				t.Errorf("%s: rewrite(%q) = %q, want an error", r.name, in, out)
+			}
+		}
+		if _, err := r.rewrite([]byte("{\"a\":1}\n"), mustParse(t, "https://example.com/"), testOptions()); err != nil {
+			t.Errorf("%s: trailing newline: %v", r.name, err)
+		}
+	}
+}
+
+func TestProxyURLQueryAndFragment(t *testing.T) {
+	tests := []struct {
+		name, target, encoded, fragment string
+	}{
+		{"query", "https://example.com/p?a=1&b=x%20y", "https://example.com/p?a=1&b=x%20y", ""},
+		{"fragment", "https://example.com/p#section", "https://example.com/p", "#section"},
+		{"both", "https://example.com/app/?q=1#/route/2", "https://example.com/app/?q=1", "#/route/2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testOptions().proxyURL(mustParse(t, tt.target))
+			want := testOrigin + "/" + encode(tt.encoded) + "?browse=1" + tt.fragment
+			if got != want {
+				t.Errorf("proxyURL(%q) = %q, want %q", tt.target, got, want)
+			}
+		})
+	}
+}
+
+func TestRewriteHTMLQueryAndFragment(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "query and fragment",
+			in:   `<a href="list?page=2&sort=asc#results">x</a>`,
+			want: []string{`href="` + proxied("https://example.com/dir/list?page=2&sort=asc") + `#results"`},
+		},
+		{
+			name: "fragment only",
+			in:   `<a href="#top">x</a>`,
+			want: []string{`href="` + proxied("https://example.com/dir/page.html") + `#top"`},
+		},
+	})
+}
+
+func TestRewriteHTMLSrcdoc(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "relative link",
+			in:   `<iframe srcdoc="<a href=&quot;next.html&quot;>next</a>"></iframe>`,
+			want: []string{`href=&#34;` + proxied("https://example.com/dir/next.html") + `&#34;`},
+		},
+		{
+			name: "entities in text",
+			in:   `<iframe srcdoc="<p>a &amp;amp; b</p>"></iframe>`,
+			want: []string{`&lt;p&gt;a &amp;amp; b&lt;/p&gt;`},
+		},
+	})
+}
+
+func TestRewriteHTMLProtocolRelative(t *testing.T) {
+	in := `<script src="//cdn.example.com/x.js"></script><img src="//img.example.com/a.png?s=1">`
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "https page",
+			base: "https://example.com/",
+			in:   in,
+			want: []string{
+				`src="` + proxied("https://cdn.example.com/x.js") + `"`,
+				`src="` + proxied("https://img.example.com/a.png?s=1") + `"`,
+			},
+		},
+		{
+			name: "http page",
+			base: "http://example.com/",
+			in:   in,
+			want: []string{`src="` + proxied("http://cdn.example.com/x.js") + `"`},
+		},
+	})
+}
+
+func TestRewriteJSLiterals(t *testing.T) {
+	runRewriteTests(t, rewriteJS, testOptions, []rewriteTest{
+		{
+			name: "template literal",
+			in:   "const u = `http://example.com/${id}`; fetch(\"/api\")",
+			want: []string{"`http://example.com/${id}`", `fetch("` + proxied("https://example.com/api") + `")`},
+		},
+		{
+			name: "regex literal",
+			in:   `if (/^https?:\/\/example\.com\//.test(s)) u = "https://a.com/x"`,
+			want: []string{`/^https?:\/\/example\.com\//.test(s)`, `u = "` + proxied("https://a.com/x") + `"`},
+		},
+		{
+			name: "regex after keyword",
+			in:   `return /"\/api"/.exec(s)`,
+			want: []string{`return /"\/api"/.exec(s)`},
+		},
+		{
+			name: "division after postfix increment",
+			in:   `x++ / 2; u = "https://a.com/y"`,
+			want: []string{`u = "` + proxied("https://a.com/y") + `"`},
+		},
+		{
+			name: "division after postfix decrement",
+			in:   `f(a)-- / 2; fetch("/b"); z = 1 / 2`,
+			want: []string{`fetch("` + proxied("https://example.com/b") + `")`},
+		},
+		{
+			name: "regex after prefix increment operand",
+			in:   `n = ++i + /"\/c"/.source.length`,
+			want: []string{`/"\/c"/.source`},
+		},
+		{
+			name: "division",
+			in:   `a = b / 2; fetch("/d"); c = d / 3`,
+			want: []string{`fetch("` + proxied("https://example.com/d") + `")`},
+		},
+	})
+}
+
+func TestRewriteHTMLEmptyFormAction(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "empty action",
+			in:   `<form action=""><input name="q"></form>`,
+			want: []string{`<form action="">`},
+		},
+		{
+			name: "empty formaction",
+			in:   `<form action="/search"><button formaction="">go</button></form>`,
+			want: []string{`<button formaction="">`, `action="` + proxied("https://example.com/search") + `"`},
+		},
+		{
+			name: "dialog form",
+			in:   `<form method="dialog" action="/close"><button>ok</button></form>`,
+			want: []string{`action="/close"`},
+		},
+	})
+}
+
+func TestRewriteHTMLNoscript(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "img",
+			in:   `<noscript><img src="/fallback.png"></noscript>`,
+			want: []string{`src="` + proxied("https://example.com/fallback.png") + `"`},
+		},
+		{
+			name: "in head",
+			in:   `<head><noscript><link rel="stylesheet" href="noscript.css"></noscript></head>`,
+			want: []string{`href="` + proxied("https://example.com/dir/noscript.css") + `"`},
+		},
+	})
+}
+
+func TestRewriteJSLocation(t *testing.T) {
+	runRewriteTests(t, rewriteJS, testOptions, []rewriteTest{
+		{
+			name: "window.location.href",
+			in:   `window.location.href = "/next"`,
+			want: []string{`window.location.href = "` + proxied("https://example.com/next") + `"`},
+		},
+		{
+			name: "bare location",
+			in:   `location='step2.html';`,
+			want: []string{`location = '` + proxied("https://example.com/dir/step2.html") + `'`},
+		},
+		{
+			name: "document.location",
+			in:   `if (done) document.location = "/home"`,
+			want: []string{`document.location = "` + proxied("https://example.com/home") + `"`},
+		},
+		{
+			name: "absolute",
+			in:   `window.location = "https://other.example/x"`,
+			want: []string{`window.location = "` + proxied("https://other.example/x") + `"`},
+		},
+		{
+			name: "read",
+			in:   `var here = location.href; if (location.href == "/next") go()`,
+			want: []string{`var here = location.href; if (location.href == "/next") go()`},
+		},
+		{
+			name: "property of another object",
+			in:   `item.location = "/warehouse"; item.location.href = "/shelf"`,
+			want: []string{`item.location = "/warehouse"; item.location.href = "/shelf"`},
+		},
+		{
+			name: "fragment",
+			in:   `location.href = "#top"`,
+			want: []string{`location.href = "#top"`},
+		},
+		{
+			name: "local variable",
+			in:   `let location = "/warehouse"; const location = '/shelf';var location="aisle"`,
+			want: []string{`let location = "/warehouse"; const location = '/shelf';var location="aisle"`},
+		},
+	})
+}
+
+func TestRewriteHTMLProxyLinks(t *testing.T) {
+	already := proxied("https://other.example/page")
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "absolute proxy link",
+			in:   `<a href="` + already + `">x</a>`,
+			want: []string{`href="` + already + `"`},
+		},
+		{
+			name: "proxy origin root",
+			in:   `<a href="` + testOrigin + `/">home</a>`,
+			want: []string{`href="` + testOrigin + `/"`},
+		},
+		{
+			name:    "proxy image",
+			in:      `<img src="` + already + `">`,
+			want:    []string{`src="` + already + `"`},
+			notWant: []string{encode(already)},
+		},
+		{
+			name: "other origin",
+			in:   `<a href="http://proxy.test.evil/x">x</a>`,
+			want: []string{`href="` + proxied("http://proxy.test.evil/x") + `"`},
+		},
+	})
+}
+
+func TestRewriteHTMLJSONLD(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "absolute URL",
+			in:   `<script type="application/ld+json">{"@context": "https://schema.org", "url": "https://example.com/about"}</script>`,
+			want: []string{`"url":"` + proxied("https://example.com/about") + `"`},
+		},
+		{
+			name: "with parameters",
+			in:   `<script type="application/ld+json; charset=utf-8">{"logo": "https://cdn.example.com/logo.png"}</script>`,
+			want: []string{`"logo":"` + proxied("https://cdn.example.com/logo.png") + `"`},
+		},
+		{
+			name:    "not run as JS",
+			in:      `<script type="application/ld+json">{"path": "/fetch(\"/x\")"}</script>`,
+			notWant: []string{encode("https://example.com/x")},
+		},
+		{
+			name:    "script end tag stays escaped",
+			in:      `<script type="application/ld+json">{"name": "<\/script><script>alert(1)<\/script>", "url": "https://example.com/a"}</script>`,
+			want:    []string{`"name":"<\/script><script>alert(1)<\/script>"`, proxied("https://example.com/a")},
+			notWant: []string{"alert(1)</script>"},
+		},
+		{
+			name: "trailing data kept",
+			in:   `<script type="application/ld+json">{"url": "https://example.com/a"}{"url": "https://example.com/b"}</script>`,
+			want: []string{`{"url": "https://example.com/a"}{"url": "https://example.com/b"}`},
+		},
+	})
+}
+
+func TestRewriteJSWebSocket(t *testing.T) {
+	runRewriteTests(t, rewriteJS, testOptions, []rewriteTest{
+		{
+			name: "wss",
+			in:   `const ws = new WebSocket("wss://host.example/ws");`,
+			want: []string{`new WebSocket("ws://proxy.test/` + encode("wss://host.example/ws") + `");`},
+		},
+		{
+			name: "ws with protocols",
+			in:   `new WebSocket('ws://host.example:8080/live?room=1', ["chat"])`,
+			want: []string{`new WebSocket('ws://proxy.test/` + encode("ws://host.example:8080/live?room=1") + `', ["chat"])`},
+		},
+		{
+			name: "relative",
+			in:   `new WebSocket("/ws")`,
+			want: []string{`new WebSocket("/ws")`},
+		},
+		{
+			name: "already proxied",
+			in:   `new WebSocket("ws://proxy.test/` + encode("wss://host.example/ws") + `")`,
+			want: []string{`new WebSocket("ws://proxy.test/` + encode("wss://host.example/ws") + `")`},
+		},
+		{
+			name:    "other scheme",
+			in:      `new WebSocket("ftp://host.example/ws")`,
+			want:    []string{`new WebSocket("ftp://host.example/ws")`},
+			notWant: []string{encode("ftp://host.example/ws")},
+		},
+	})
+	httpsOptions := func() *rewriteOptions {
+		opts := testOptions()
+		opts.origin = "https://proxy.test"
+		return opts
+	}
+	runRewriteTests(t, rewriteJS, httpsOptions, []rewriteTest{
+		{
+			name: "https origin",
+			in:   `new WebSocket("ws://host.example/ws")`,
+			want: []string{`new WebSocket("wss://proxy.test/` + encode("ws://host.example/ws") + `")`},
+		},
+	})
+}
+
+func TestRewriteManifest(t *testing.T) {
+	const base = "https://example.com/app/manifest.json"
+	runRewriteTests(t, rewriteManifest, testOptions, []rewriteTest{
+		{
+			name: "start_url and icons",
+			base: base,
+			in:   `{"name": "App", "start_url": "/app/?source=pwa", "icons": [{"src": "icon-192.png", "sizes": "192x192"}]}`,
+			want: []string{
+				`"start_url":"` + proxied("https://example.com/app/?source=pwa") + `"`,
+				`"src":"` + proxied("https://example.com/app/icon-192.png") + `"`,
+				`"sizes":"192x192"`,
+				`"name":"App"`,
+			},
+		},
+		{
+			name: "scope",
+			base: base,
+			in:   `{"scope": "/app/"}`,
+			want: []string{`"scope":"` + testOrigin + `/"`},
+		},
+		{
+			name: "shortcuts and screenshots",
+			base: base,
+			in:   `{"shortcuts": [{"url": "/app/new", "icons": [{"src": "/new.png"}]}], "screenshots": [{"src": "https://cdn.example.com/s.png"}]}`,
+			want: []string{
+				`"url":"` + proxied("https://example.com/app/new") + `"`,
+				`"src":"` + proxied("https://example.com/new.png") + `"`,
+				`"src":"` + proxied("https://cdn.example.com/s.png") + `"`,
+			},
+		},
+	})
+}
+
+func TestRewriteHTMLExtraAttrs(t *testing.T) {
+	extraOptions := func() *rewriteOptions {
+		opts := testOptions()
+		opts.extraAttrs = attrSets(map[string][]string{"my-player": {"Data-Stream"}})
+		return opts
+	}
+	runRewriteTests(t, rewriteHTML, extraOptions, []rewriteTest{
+		{
+			name: "custom element",
+			in:   `<my-player data-stream="live.m3u8"></my-player>`,
+			want: []string{`data-stream="` + proxied("https://example.com/dir/live.m3u8") + `"`},
+		},
+		{
+			name: "other element",
+			in:   `<div data-stream="live.m3u8"></div>`,
+			want: []string{`data-stream="live.m3u8"`},
+		},
+	})
+}
+
+func TestRewriteHTMLSameOriginOnly(t *testing.T) {
+	const browseInput = `<input type="hidden" name="browse" value="1"/>`
+	sameOriginOptions := func() *rewriteOptions {
+		opts := testOptions()
+		opts.sameOriginOnly = true
+		return opts
+	}
+	runRewriteTests(t, rewriteHTML, sameOriginOptions, []rewriteTest{
+		{
+			name: "same-origin link",
+			in:   `<a href="/about">about</a>`,
+			want: []string{`href="` + proxied("https://example.com/about") + `"`},
+		},
+		{
+			name: "cross-origin script",
+			in:   `<script src="https://cdn.example.net/lib.js" integrity="sha384-abc"></script>`,
+			want: []string{`src="https://cdn.example.net/lib.js"`, `integrity="sha384-abc"`},
+		},
+		{
+			name: "relative to cross-origin base",
+			in:   `<base href="https://cdn.example.net/assets/"><img src="logo.png">`,
+			want: []string{`src="https://cdn.example.net/assets/logo.png"`},
+		},
+		{
+			name: "same-origin form",
+			in:   `<form action="/search"><input name="q"></form>`,
+			want: []string{`action="` + proxied("https://example.com/search") + `"`, browseInput},
+		},
+		{
+			name: "form without action",
+			in:   `<form><input name="q"></form>`,
+			want: []string{browseInput},
+		},
+		{
+			name:    "cross-origin form",
+			in:      `<form action="https://search.example.net/"><input name="q"></form>`,
+			want:    []string{`action="https://search.example.net/"`},
+			notWant: []string{browseInput},
+		},
+		{
+			name: "inline CSS",
+			in:   `<style>a { background: url(/bg.png) } b { background: url(https://cdn.example.net/bg.png) }</style>`,
+			want: []string{
+				`url(` + proxied("https://example.com/bg.png") + `)`,
+				`url(https://cdn.example.net/bg.png)`,
+			},
+		},
+		{
+			name:    "style attribute",
+			in:      `<div style="background: url('https://cdn.example.net/bg.png')">x</div>`,
+			want:    []string{`https://cdn.example.net/bg.png`},
+			notWant: []string{encode("https://cdn.example.net/bg.png")},
+		},
+		{
+			name: "inline script",
+			in:   `<script>fetch("/api"); fetch("https://api.example.net/data");</script>`,
+			want: []string{
+				`fetch("` + proxied("https://example.com/api") + `")`,
+				`fetch("https://api.example.net/data")`,
+			},
+		},
+	})
+}
+
+func TestRewriteCSSImageSet(t *testing.T) {
+	runRewriteTests(t, rewriteCSS, testOptions, []rewriteTest{
+		{
+			name: "url images",
+			in:   `.a{background-image:image-set(url(a.png) 1x, url("b.png") 2x)}`,
+			want: []string{`image-set(url(` + proxied("https://example.com/dir/a.png") + `) 1x, url("` + proxied("https://example.com/dir/b.png") + `") 2x)`},
+		},
+		{
+			name: "string images",
+			in:   `.b{background-image:-webkit-image-set("/a.png" 1x, '/b.png' 2x)}`,
+			want: []string{`-webkit-image-set("` + proxied("https://example.com/a.png") + `" 1x, '` + proxied("https://example.com/b.png") + `' 2x)`},
+		},
+		{
+			name: "type descriptor",
+			in:   `.c{background-image:image-set("a.avif" type("image/avif"), "a.jpg" type("image/jpeg"))}`,
+			want: []string{
+				`"` + proxied("https://example.com/dir/a.avif") + `" type("image/avif")`,
+				`"` + proxied("https://example.com/dir/a.jpg") + `" type("image/jpeg")`,
+			},
+		},
+		{
+			name: "string outside image-set",
+			in:   `.d::before{content:"/not-a-url.png"}`,
+			want: []string{`content:"/not-a-url.png"`},
+		},
+	})
+}
+
+func TestRewriteJSAJAX(t *testing.T) {
+	ajaxOptions := func() *rewriteOptions {
+		opts := testOptions()
+		opts.rewriteAJAX = true
+		return opts
+	}
+	runRewriteTests(t, rewriteJS, ajaxOptions, []rewriteTest{
+		{
+			name: "axios.get",
+			in:   `axios.get("/api/items").then(render)`,
+			want: []string{`axios.get("` + proxied("https://example.com/api/items") + `")`},
+		},
+		{
+			name: "axios.post",
+			in:   `axios.post('/api/items', {name: "x"})`,
+			want: []string{`axios.post('` + proxied("https://example.com/api/items") + `', {name: "x"})`},
+		},
+		{
+			name: "jQuery ajax url option",
+			in:   `$.ajax({url: "/api/save", method: "POST"})`,
+			want: []string{`url: "` + proxied("https://example.com/api/save") + `"`},
+		},
+		{
+			name: "$.getJSON",
+			in:   `$.getJSON("/api/list.json", cb)`,
+			want: []string{`$.getJSON("` + proxied("https://example.com/api/list.json") + `", cb)`},
+		},
+		{
+			name: "relative",
+			in:   `axios.get("api/items")`,
+			want: []string{`axios.get("api/items")`},
+		},
+	})
+	runRewriteTests(t, rewriteJS, testOptions, []rewriteTest{
+		{
+			name: "disabled",
+			in:   `axios.get("/api/items")`,
+			want: []string{`axios.get("/api/items")`},
+		},
+	})
+}
+
+func TestRewriteHTMLPictureSources(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "picture",
+			in: `<picture>` +
+				`<source srcset="/a.avif 1x, /a@2x.avif 2x" type="image/avif">` +
+				`<source srcset="a.webp" media="(min-width: 600px)">` +
+				`<img src="a.jpg" srcset="a-400.jpg 400w, a-800.jpg 800w">` +
+				`</picture>`,
+			want: []string{
+				`srcset="` + proxied("https://example.com/a.avif") + ` 1x, ` + proxied("https://example.com/a@2x.avif") + ` 2x"`,
+				`srcset="` + proxied("https://example.com/dir/a.webp") + `"`,
+				`src="` + proxied("https://example.com/dir/a.jpg") + `"`,
+				`srcset="` + proxied("https://example.com/dir/a-400.jpg") + ` 400w, ` + proxied("https://example.com/dir/a-800.jpg") + ` 800w"`,
+			},
+		},
+		{
+			name: "commas inside URLs",
+			in:   `<img srcset="/img/w_100,h_50/a.jpg 1x,/img/w_200,h_100/a.jpg 2x">`,
+			want: []string{`srcset="` + proxied("https://example.com/img/w_100,h_50/a.jpg") + ` 1x, ` + proxied("https://example.com/img/w_200,h_100/a.jpg") + ` 2x"`},
+		},
+		{
+			name: "media sources and tracks",
+			in:   `<video><source src="/movie.webm" type="video/webm"><track src="subs.vtt" kind="captions"></video><audio><source src="/song.ogg"></audio>`,
+			want: []string{
+				`src="` + proxied("https://example.com/movie.webm") + `"`,
+				`src="` + proxied("https://example.com/dir/subs.vtt") + `"`,
+				`src="` + proxied("https://example.com/song.ogg") + `"`,
+			},
+		},
+		{
+			name: "preload imagesrcset",
+			in:   `<link rel="preload" as="image" imagesrcset="/hero.jpg 1x, /hero@2x.jpg 2x">`,
+			want: []string{`imagesrcset="` + proxied("https://example.com/hero.jpg") + ` 1x, ` + proxied("https://example.com/hero@2x.jpg") + ` 2x"`},
+		},
+	})
+}
+
+func TestRewriteHTMLSVG(t *testing.T) {
+	runRewriteTests(t, rewriteHTML, testOptions, []rewriteTest{
+		{
+			name: "xlink:href sprite",
+			in:   `<svg><use xlink:href="/sprite.svg#icon"></use></svg>`,
+			want: []string{`<use xlink:href="` + proxied("https://example.com/sprite.svg") + `#icon">`},
+		},
+		{
+			name: "href image",
+			in:   `<svg><image href="img/a.png"></image></svg>`,
+			want: []string{`<image href="` + proxied("https://example.com/dir/img/a.png") + `">`},
+		},
+		{
+			name: "local references",
+			in:   `<svg><linearGradient id="b" xlink:href="#a"></linearGradient><use href="#icon"></use></svg>`,
+			want: []string{`xlink:href="#a"`, `<use href="#icon">`},
+		},
+	})
+}
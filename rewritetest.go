@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// ServeRewriteTest rewrites the body of a POST request as if it were a
+// browse mode response from the URL in its base query parameter, and writes
+// back the result without proxying anything. The rewriter is chosen by the
+// request's Content-Type, as it would be by the response's. It is meant for
+// debugging the rewriters, so the result is sent as plain text.
+func (p *Proxy) ServeRewriteTest(w http.ResponseWriter, r *http.Request) {
+	if !p.checkAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		p.httpError(w, "", "Use POST with the content to rewrite", http.StatusMethodNotAllowed)
+		return
+	}
+	base, err := url.Parse(r.URL.Query().Get("base"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		p.httpError(w, "", "Missing or invalid base URL", http.StatusBadRequest)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	rewriter := p.rewriterFor(contentType)
+	if rewriter == nil {
+		p.httpError(w, base.String(), "No rewriter for "+mediaType(contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, p.MaxRewriteBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		p.httpError(w, base.String(), "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		p.httpError(w, base.String(), "Error reading request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rewriter == htmlRewriter {
+		if body, err = htmlToUTF8(body, contentType); err != nil {
+			p.httpError(w, base.String(), "Error decoding HTML: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	rewritten, err := rewriter.rewrite(body, base, p.rewriteOptions(r))
+	if err != nil {
+		p.httpError(w, base.String(), "Error rewriting "+rewriter.name+": "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(rewritten)
+}
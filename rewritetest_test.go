@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServeRewriteTest(t *testing.T) {
+	base := "https://site.test/dir/page.html"
+	tests := []struct {
+		name        string
+		method      string
+		base        string
+		contentType string
+		body        string
+		wantStatus  int
+		want        string
+	}{
+		{"HTML", http.MethodPost, base, "text/html", `<a href="/next">next</a>`, http.StatusOK, `href="http://example.com/` + encode("https://site.test/next") + `?browse=1"`},
+		{"CSS", http.MethodPost, base, "text/css", `a{background:url(bg.png)}`, http.StatusOK, `url(http://example.com/` + encode("https://site.test/dir/bg.png") + `?browse=1)`},
+		{"no rewriter", http.MethodPost, base, "image/png", "png", http.StatusUnsupportedMediaType, ""},
+		{"missing base", http.MethodPost, "", "text/html", "<p>", http.StatusBadRequest, ""},
+		{"relative base", http.MethodPost, "/page", "text/html", "<p>", http.StatusBadRequest, ""},
+		{"GET", http.MethodGet, base, "", "", http.StatusMethodNotAllowed, ""},
+	}
+	p := newTestProxy(Options{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/rewrite-test?base="+url.QueryEscape(tt.base), strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			p.ServeRewriteTest(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.want) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// robotsTag is the X-Robots-Tag value set on proxied responses when
+// BlockRobots is set.
+const robotsTag = "noindex, nofollow"
+
+// ServeRobots writes a robots.txt that disallows crawling everything.
+func (p *Proxy) ServeRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Robots-Tag", robotsTag)
+	io.WriteString(w, "User-agent: *\nDisallow: /\n")
+}
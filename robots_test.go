@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBlockRobots(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "all")
+		w.Write([]byte("hello"))
+	})
+	tests := []struct {
+		name        string
+		blockRobots bool
+		want        string
+	}{
+		{"disabled", false, "all"},
+		{"enabled", true, robotsTag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(Options{BlockRobots: tt.blockRobots})
+			rec := get(p, upstream.URL, "")
+			if got := rec.Header().Get("X-Robots-Tag"); got != tt.want {
+				t.Errorf("X-Robots-Tag = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeRobots(t *testing.T) {
+	p := newTestProxy(Options{BlockRobots: true})
+	rec := httptest.NewRecorder()
+	p.ServeRobots(rec, httptest.NewRequest(http.MethodGet, "/robots.txt", nil))
+	if got, want := rec.Body.String(), "User-agent: *\nDisallow: /\n"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+	if got := rec.Header().Get("X-Robots-Tag"); got != robotsTag {
+		t.Errorf("X-Robots-Tag = %q, want %q", got, robotsTag)
+	}
+}
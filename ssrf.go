@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// errBlockedAddress is returned when an upstream host resolves to an internal address.
+var errBlockedAddress = errors.New("upstream address is not allowed")
+
+// blockedNets lists internal ranges not covered by the net.IP helper methods.
+var blockedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "this" network
+		"100.64.0.0/10", // carrier-grade NAT
+		"198.18.0.0/15", // benchmarking
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isBlockedIP reports whether ip is a loopback, private, link-local, or
+// otherwise internal address.
+func isBlockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUpstreamHost returns errBlockedAddress if host is denied or, unless
+// AllowPrivate is set, resolves to an internal address. Lookup failures are
+// left for the dial to report.
+func (p *Proxy) checkUpstreamHost(ctx context.Context, host string) error {
+	if p.isDeniedHost(host) {
+		return fmt.Errorf("%w: %s is denied", errBlockedAddress, host)
+	}
+	if p.AllowPrivate {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if isBlockedIP(ip) {
+			return fmt.Errorf("%w: %s", errBlockedAddress, ip)
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if isBlockedIP(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", errBlockedAddress, host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// isDeniedHost reports whether host is, or is a subdomain of, an entry in
+// DenyHosts.
+func (p *Proxy) isDeniedHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range p.DenyHosts {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDenyHosts lowercases the DenyHosts entries and strips any
+// leading "*." or ".", so that all spellings match the same way.
+func normalizeDenyHosts(hosts []string) []string {
+	var domains []string
+	for _, domain := range hosts {
+		if domain = normalizeDomain(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// normalizeDomain lowercases a domain entry such as "*.Example.com" and
+// strips any leading "*." or "." and trailing dot.
+func normalizeDomain(domain string) string {
+	domain = strings.TrimPrefix(strings.TrimSpace(strings.ToLower(domain)), "*")
+	return strings.Trim(domain, ".")
+}
+
+// dialControl runs just before each upstream connection is made and rejects
+// internal addresses. Checking the dialed address, rather than only the
+// earlier lookup, keeps a DNS rebind from slipping past checkUpstreamHost.
+func (p *Proxy) dialControl(network, address string, _ syscall.RawConn) error {
+	if p.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && isBlockedIP(ip) {
+		return fmt.Errorf("%w: %s", errBlockedAddress, ip)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestIsBlockedIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fc00::1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::", false},
+	}
+	for _, tt := range tests {
+		if got := isBlockedIP(net.ParseIP(tt.ip)); got != tt.blocked {
+			t.Errorf("isBlockedIP(%s) = %v, want %v", tt.ip, got, tt.blocked)
+		}
+	}
+}
+
+func TestPrivateUpstreamBlocked(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "internal")
+	})
+	tests := []struct {
+		name         string
+		allowPrivate bool
+		want         int
+	}{
+		{"blocked", false, http.StatusForbidden},
+		{"allowed", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProxy(Options{AllowPrivate: tt.allowPrivate, Logger: log.New(io.Discard, "", 0)})
+			if rec := get(p, upstream.URL, ""); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+// A name that passed checkUpstreamHost may resolve differently when dialed,
+// so the dialed address is checked again.
+func TestDialControlRejectsInternalAddress(t *testing.T) {
+	p := NewProxy(Options{Logger: log.New(io.Discard, "", 0)})
+	if err := p.dialControl("tcp", "127.0.0.1:80", nil); !errors.Is(err, errBlockedAddress) {
+		t.Errorf("dialControl(127.0.0.1:80) = %v, want errBlockedAddress", err)
+	}
+	if err := p.dialControl("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("dialControl(93.184.216.34:443) = %v, want nil", err)
+	}
+}
+
+func TestDenyHosts(t *testing.T) {
+	p := newTestProxy(Options{DenyHosts: []string{"*.Evil.example", ".tracker.example", "blocked.example."}})
+	tests := []struct {
+		host   string
+		denied bool
+	}{
+		{"evil.example", true},
+		{"www.evil.example", true},
+		{"a.b.tracker.example", true},
+		{"BLOCKED.example", true},
+		{"blocked.example.", true},
+		{"notevil.example", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := p.isDeniedHost(tt.host); got != tt.denied {
+			t.Errorf("isDeniedHost(%q) = %v, want %v", tt.host, got, tt.denied)
+		}
+	}
+
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	if rec := get(p, "http://www.evil.example/", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("denied host: status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := get(p, upstream.URL, ""); rec.Code != http.StatusOK {
+		t.Errorf("allowed host: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxStatsHosts bounds how many distinct upstream hosts are counted, so that
+// a client requesting many random hosts can't grow the table without limit.
+const maxStatsHosts = 1000
+
+// topStatsHosts is how many hosts the stats endpoint lists.
+const topStatsHosts = 10
+
+// stats holds the in-memory counters served by ServeStats.
+type stats struct {
+	mu       sync.Mutex
+	start    time.Time
+	total    int64
+	inFlight int64
+	hosts    map[string]int64
+}
+
+func newStats() *stats {
+	return &stats{start: time.Now(), hosts: make(map[string]int64)}
+}
+
+// begin counts a request as served and in flight; the returned function
+// marks it done.
+func (s *stats) begin() func() {
+	s.mu.Lock()
+	s.total++
+	s.inFlight++
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}
+}
+
+// countHost counts a request to an upstream host.
+func (s *stats) countHost(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hosts[host]; ok || len(s.hosts) < maxStatsHosts {
+		s.hosts[host]++
+	}
+}
+
+// hostCount is one entry of the stats endpoint's top hosts.
+type hostCount struct {
+	Host     string `json:"host"`
+	Requests int64  `json:"requests"`
+}
+
+// ServeStats writes the proxy's request counters as JSON: requests served
+// and in flight, and the upstream hosts requested most since the Proxy was
+// created. It requires the same credentials as the proxy, as they reveal
+// which sites it is used for.
+func (p *Proxy) ServeStats(w http.ResponseWriter, r *http.Request) {
+	if !p.checkAuth(w, r) {
+		return
+	}
+	s := p.stats
+	s.mu.Lock()
+	top := make([]hostCount, 0, len(s.hosts))
+	for host, n := range s.hosts {
+		top = append(top, hostCount{host, n})
+	}
+	resp := struct {
+		Uptime   string      `json:"uptime"`
+		Total    int64       `json:"total_requests"`
+		InFlight int64       `json:"in_flight"`
+		TopHosts []hostCount `json:"top_hosts"`
+	}{time.Since(s.start).Round(time.Second).String(), s.total, s.inFlight, nil}
+	s.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Requests != top[j].Requests {
+			return top[i].Requests > top[j].Requests
+		}
+		return top[i].Host < top[j].Host
+	})
+	if len(top) > topStatsHosts {
+		top = top[:topStatsHosts]
+	}
+	resp.TopHosts = top
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeStats(t *testing.T) {
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	p := newTestProxy(Options{})
+	for i := 0; i < 3; i++ {
+		get(p, upstream.URL, "")
+	}
+	get(p, "http://other.invalid/", "")
+
+	rec := httptest.NewRecorder()
+	p.ServeStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var got struct {
+		Total    int64       `json:"total_requests"`
+		InFlight int64       `json:"in_flight"`
+		TopHosts []hostCount `json:"top_hosts"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	host := mustParse(t, upstream.URL).Host
+	want := []hostCount{{host, 3}, {"other.invalid", 1}}
+	if got.Total != 4 || got.InFlight != 0 || len(got.TopHosts) != len(want) {
+		t.Fatalf("stats = %+v, want 4 requests, none in flight, and top hosts %v", got, want)
+	}
+	for i := range want {
+		if got.TopHosts[i] != want[i] {
+			t.Errorf("top host %d = %v, want %v", i, got.TopHosts[i], want[i])
+		}
+	}
+}
+
+func TestServeStatsAuth(t *testing.T) {
+	p := newTestProxy(Options{AuthUser: "alice", AuthPass: "secret"})
+	tests := []struct {
+		name       string
+		user, pass string
+		want       int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong credentials", "alice", "guess", http.StatusUnauthorized},
+		{"correct credentials", "alice", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			rec := httptest.NewRecorder()
+			p.ServeStats(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// isWebSocketUpgrade reports whether r asks to switch to the WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// proxyWebSocket tunnels a WebSocket connection to upstream. The upstream is
+// dialed directly, the client's handshake is replayed on it, and bytes are
+// then copied both ways until either side closes. The http and https schemes
+// of the decoded URL map to ws and wss. The handshake's headers follow the
+// same policy as any upstream request outside browse mode, given forward
+// and the injected headers; see setUpstreamHeaders.
+func (p *Proxy) proxyWebSocket(w http.ResponseWriter, r *http.Request, upstream *url.URL, forward bool, injected http.Header) {
+	var useTLS bool
+	switch upstream.Scheme {
+	case "http", "ws":
+	case "https", "wss":
+		useTLS = true
+	default:
+		p.httpError(w, upstream.String(), "Unsupported WebSocket scheme: "+upstream.Scheme, http.StatusBadRequest)
+		return
+	}
+	address := upstream.Host
+	if upstream.Port() == "" {
+		port := "80"
+		if useTLS {
+			port = "443"
+		}
+		address = net.JoinHostPort(upstream.Hostname(), port)
+	}
+
+	// Dial the upstream.
+	upstreamConn, err := p.dial(r.Context(), "tcp", address)
+	if err == nil && useTLS {
+		config := p.upstreamTLSConfig()
+		if config.ServerName == "" {
+			config.ServerName = upstream.Hostname()
+		}
+		tlsConn := tls.Client(upstreamConn, config)
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		err = tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			upstreamConn.Close()
+		}
+		upstreamConn = tlsConn
+	}
+	if errors.Is(err, errBlockedAddress) {
+		p.logger(r.Context()).Printf("Blocked upstream %s: %v", upstream.Host, err)
+		p.httpError(w, upstream.String(), "Upstream host is not allowed: "+upstream.Hostname(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		p.httpError(w, upstream.String(), "Upstream WebSocket dial failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+
+	// Replay the handshake. The request line and Host come from the decoded
+	// URL, unless UpstreamHost overrides the Host, and the headers from
+	// setUpstreamHeaders, with the upgrade restored and Origin, which would
+	// otherwise name the proxy, naming the upstream.
+	handshakeURL := *upstream
+	handshakeURL.Scheme = "http"
+	if useTLS {
+		handshakeURL.Scheme = "https"
+	}
+	req, err := http.NewRequest(r.Method, handshakeURL.String(), nil)
+	if err != nil {
+		p.httpError(w, upstream.String(), "Failed to create upstream request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.setUpstreamHeaders(req, r, forward, false, injected)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if req.Header.Get("Origin") != "" {
+		req.Header.Set("Origin", handshakeURL.Scheme+"://"+upstream.Host)
+	}
+	if err := req.Write(upstreamConn); err != nil {
+		p.httpError(w, upstream.String(), "Upstream WebSocket handshake failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// Take over the client connection. The upstream's handshake response is
+	// passed through as-is along with everything after it.
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		p.httpError(w, upstream.String(), "WebSocket upgrade not supported: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	if err := tunnel(clientConn, clientBuf, upstreamConn); err != nil {
+		p.logger(r.Context()).Printf("WebSocket tunnel to %s closed: %v", upstream.String(), err)
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoWebSocket starts an upstream that accepts any WebSocket handshake
+// and then echoes the bytes it receives. Each handshake request is sent on
+// the returned channel.
+func newEchoWebSocket(t *testing.T) (*httptest.Server, <-chan *http.Request) {
+	t.Helper()
+	handshakes := make(chan *http.Request, 1)
+	upstream := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		handshakes <- r
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, buf)
+	})
+	return upstream, handshakes
+}
+
+// dialWebSocket sends a WebSocket handshake for path to the proxy at addr,
+// with the extra header lines given, and returns the connection once the
+// 101 response has been read.
+func dialWebSocket(t *testing.T, addr, path string, extra ...string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	handshake := "GET " + path + " HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	for _, line := range extra {
+		handshake += line + "\r\n"
+	}
+	io.WriteString(conn, handshake+"\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", resp.StatusCode)
+	}
+	return conn, br
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	upstream, _ := newEchoWebSocket(t)
+	px := httptest.NewServer(newTestProxy(Options{}))
+	defer px.Close()
+
+	conn, br := dialWebSocket(t, px.Listener.Addr().String(), "/"+encode(upstream.URL+"/ws"))
+	// A masked text frame holding "hi".
+	frame := []byte{0x81, 0x82, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(frame))
+	if _, err := io.ReadFull(br, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != string(frame) {
+		t.Errorf("echo = %v, want %v", echo, frame)
+	}
+}
+
+func TestWebSocketSchemes(t *testing.T) {
+	p := newTestProxy(Options{})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	p.proxyWebSocket(rec, req, mustParse(t, "ftp://example.com/"), false, nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "ftp") {
+		t.Errorf("ftp: got %d %q, want 400", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWebSocketStripsProxyCredentials(t *testing.T) {
+	upstream, handshakes := newEchoWebSocket(t)
+	px := httptest.NewServer(newTestProxy(Options{AuthUser: "alice", AuthPass: "secret"}))
+	defer px.Close()
+
+	// "alice:secret"
+	dialWebSocket(t, px.Listener.Addr().String(), "/"+encode(upstream.URL+"/ws"), "Authorization: Basic YWxpY2U6c2VjcmV0")
+	if v := (<-handshakes).Header.Get("Authorization"); v != "" {
+		t.Errorf("upstream handshake has Authorization %q", v)
+	}
+}
+
+func TestWebSocketScopesCookies(t *testing.T) {
+	upstream, handshakes := newEchoWebSocket(t)
+	px := httptest.NewServer(newTestProxy(Options{}))
+	defer px.Close()
+
+	// httptest servers listen on 127.0.0.1.
+	dialWebSocket(t, px.Listener.Addr().String(), "/"+encode(upstream.URL+"/ws"), "Cookie: 127.0.0.1|sid=x; example.com|sid=y; theme=dark")
+	if got, want := (<-handshakes).Header.Get("Cookie"), "sid=x; theme=dark"; got != want {
+		t.Errorf("upstream handshake has Cookie %q, want %q", got, want)
+	}
+}
+
+func TestWebSocketHeaderPolicy(t *testing.T) {
+	upstream, handshakes := newEchoWebSocket(t)
+	px := httptest.NewServer(newTestProxy(Options{UserAgent: "proxy-bot", ForwardClientIP: true, EnableHeaderInjection: true}))
+	defer px.Close()
+
+	dialWebSocket(t, px.Listener.Addr().String(), "/"+encode(upstream.URL+"/ws")+"?h_X-Api-Key=abc",
+		"User-Agent: browser", "Keep-Alive: timeout=5")
+	h := (<-handshakes).Header
+	tests := []struct {
+		name, want string
+	}{
+		{"User-Agent", "proxy-bot"},
+		{"X-Forwarded-For", "127.0.0.1"},
+		{"X-Api-Key", "abc"},
+		{"Keep-Alive", ""},
+		{"Upgrade", "websocket"},
+		{"Connection", "Upgrade"},
+	}
+	for _, tt := range tests {
+		if got := h.Get(tt.name); got != tt.want {
+			t.Errorf("upstream handshake has %s %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
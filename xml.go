@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// xmlURLElements are the feed elements whose text is a URL, such as RSS
+// <link> and <comments> or Atom <icon>.
+var xmlURLElements = map[string]bool{
+	"link": true, "url": true, "comments": true, "icon": true, "logo": true,
+}
+
+// xmlURLAttrs are the attributes, with any namespace prefix, that hold URLs,
+// such as Atom <link href>, RSS <enclosure url> and xlink:href.
+var xmlURLAttrs = map[string]bool{"href": true, "src": true, "url": true}
+
+// rewriteXML rewrites the URLs in an RSS, Atom, SVG or other XML document. Only
+// the tokens that change are re-encoded; the rest of the document, including
+// CDATA sections, comments and namespace prefixes, is copied byte for byte.
+func rewriteXML(content []byte, base *url.URL, opts *rewriteOptions) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(content))
+	// Feeds in the wild are often not well-formed, with bare ampersands
+	// or HTML entities such as &nbsp;. Accept them as a browser would
+	// rather than failing the whole response.
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	var out bytes.Buffer
+	var last int64
+	urlText := false // whether character data is the text of a URL element
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset := dec.InputOffset()
+		raw := content[last:offset]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			urlText = xmlURLElements[t.Name.Local]
+			if rewriteXMLAttrs(t.Attr, base, opts) {
+				raw = formatXMLStart(t, bytes.HasSuffix(raw, []byte("/>")))
+			}
+		case xml.EndElement:
+			urlText = false
+		case xml.CharData:
+			if urlText {
+				raw = rewriteXMLText(raw, string(t), base, opts)
+			}
+		}
+		out.Write(raw)
+		last = offset
+	}
+	out.Write(content[last:])
+	return out.Bytes(), nil
+}
+
+// rewriteXMLAttrs rewrites the URL attributes in attrs in place and reports
+// whether any changed.
+func rewriteXMLAttrs(attrs []xml.Attr, base *url.URL, opts *rewriteOptions) bool {
+	changed := false
+	for i, attr := range attrs {
+		// Fragment-only references, as in SVG <use href="#icon">, point
+		// into the document itself.
+		if attr.Name.Space == "xmlns" || !xmlURLAttrs[attr.Name.Local] || isLocalRef(attr.Value) {
+			continue
+		}
+		if resolved, err := resolveURL(base, attr.Value); err == nil {
+			attrs[i].Value = opts.proxyURL(resolved)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// rewriteXMLText returns the rewritten raw bytes of the character data text,
+// keeping a CDATA section a CDATA section and the surrounding whitespace.
+func rewriteXMLText(raw []byte, text string, base *url.URL, opts *rewriteOptions) []byte {
+	ref := strings.TrimSpace(text)
+	if ref == "" {
+		return raw
+	}
+	resolved, err := resolveURL(base, ref)
+	if err != nil {
+		return raw
+	}
+	start := strings.Index(text, ref)
+	rewritten := text[:start] + opts.proxyURL(resolved) + text[start+len(ref):]
+	if bytes.HasPrefix(raw, []byte("<![CDATA[")) {
+		return []byte("<![CDATA[" + rewritten + "]]>")
+	}
+	return []byte(xmlTextEscaper.Replace(rewritten))
+}
+
+var (
+	xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	// xmlAttrEscaper also escapes whitespace that attribute value
+	// normalization would otherwise turn into spaces.
+	xmlAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;",
+		"\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+// formatXMLStart encodes a start tag as read by xml.Decoder.RawToken, whose
+// names still carry their original prefixes.
+func formatXMLStart(t xml.StartElement, selfClosing bool) []byte {
+	var b bytes.Buffer
+	b.WriteString("<" + xmlQName(t.Name))
+	for _, attr := range t.Attr {
+		b.WriteString(" " + xmlQName(attr.Name) + `="` + xmlAttrEscaper.Replace(attr.Value) + `"`)
+	}
+	if selfClosing {
+		b.WriteString("/>")
+	} else {
+		b.WriteString(">")
+	}
+	return b.Bytes()
+}
+
+func xmlQName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
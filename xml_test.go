@@ -0,0 +1,54 @@
+package proxy
+
+import "testing"
+
+func TestRewriteXML(t *testing.T) {
+	runRewriteTests(t, rewriteXML, testOptions, []rewriteTest{
+		{
+			name: "Atom",
+			base: "https://example.com/feed.xml",
+			in: `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <link href="/" rel="alternate"/>
+  <icon>/favicon.ico</icon>
+  <entry><title>Post</title><link href="https://example.com/posts/1"/></entry>
+</feed>`,
+			want: []string{
+				`<feed xmlns="http://www.w3.org/2005/Atom">`,
+				`<link href="` + proxied("https://example.com/") + `" rel="alternate"/>`,
+				`<icon>` + proxied("https://example.com/favicon.ico") + `</icon>`,
+				`<link href="` + proxied("https://example.com/posts/1") + `"/>`,
+			},
+		},
+		{
+			name: "RSS with CDATA",
+			base: "https://example.com/rss",
+			in:   `<rss xmlns:media="http://search.yahoo.com/mrss/"><channel><link><![CDATA[https://example.com/]]></link><item><media:content url="/v.mp4"/><description><![CDATA[<a href="/x">x</a>]]></description></item></channel></rss>`,
+			want: []string{
+				`<link><![CDATA[` + proxied("https://example.com/") + `]]></link>`,
+				`<media:content url="` + proxied("https://example.com/v.mp4") + `"/>`,
+				`<description><![CDATA[<a href="/x">x</a>]]></description>`,
+			},
+		},
+		{
+			name: "HTML entities and bare ampersands",
+			base: "https://example.com/rss",
+			in:   `<rss><channel><title>News&nbsp;&copy; A & B</title><link>/a?x=1&y=2</link></channel></rss>`,
+			want: []string{
+				`<title>News&nbsp;&copy; A & B</title>`,
+				`<link>` + proxied("https://example.com/a?x=1&y=2") + `</link>`,
+			},
+		},
+		{
+			name: "SVG",
+			base: "https://example.com/img/icons.svg",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="sprite.svg#star"/><use href="#local"/><image href="/bg.png"/></svg>`,
+			want: []string{
+				`xmlns:xlink="http://www.w3.org/1999/xlink"`,
+				`<use xlink:href="` + proxied("https://example.com/img/sprite.svg") + `#star"/>`,
+				`<use href="#local"/>`,
+				`<image href="` + proxied("https://example.com/bg.png") + `"/>`,
+			},
+		},
+	})
+}